@@ -0,0 +1,225 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "path"
+  "sync"
+  "time"
+  "bufio"
+  "bytes"
+  "os/exec"
+  "runtime"
+  "strings"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/csv"
+  "encoding/json"
+)
+
+// convergence information written by 'on --stats'
+type runStats struct {
+  Input      string  `json:"input"`
+  Iterations int     `json:"iterations"`
+  Residual   float32 `json:"residual"`
+  Seconds    float64 `json:"seconds"`
+}
+
+// save the summary of a simulation as json
+func saveStats( stats solverStats, input string, fn string, verbose bool ) {
+  if verbose {
+    p(fmt.Sprintf("writing file %s...", fn))
+  }
+  buf, _ := json.MarshalIndent(runStats{input, stats.iterations, stats.residual, stats.elapsed.Seconds()}, "", "  ")
+  if err := ioutil.WriteFile(fn, append(buf, '\n'), 0644); err != nil {
+    p(fmt.Sprintf("Error: could not write file %s", fn))
+  }
+}
+
+// result of one subject of a batch
+type batchResult struct {
+  subject, input string
+  ok bool
+  seconds float64
+  stats runStats
+  message string
+}
+
+// Split the arguments of the batch command into inputs and the options passed to 'on'. Inputs
+// end at a '--' or at the first option. Inputs are file names or glob patterns, the list file
+// contains one input (or pattern) per line.
+func batchArguments( args []string, list string ) ( []string, []string, error ) {
+  var patterns, options []string
+  for n, a := range args {
+    if a == "--" {
+      options = args[n+1:]
+      break
+    }
+    if strings.HasPrefix(a, "-") {
+      options = args[n:]
+      break
+    }
+    patterns = append(patterns, a)
+  }
+  if list != "" {
+    buf, err := ioutil.ReadFile(list)
+    if err != nil {
+      return nil, nil, fmt.Errorf("could not read list file %s", list)
+    }
+    for _, l := range strings.Split(string(buf), "\n") {
+      l = strings.TrimSpace(l)
+      if l != "" && !strings.HasPrefix(l, "#") {
+        patterns = append(patterns, l)
+      }
+    }
+  }
+  var inputs []string
+  seen := map[string]bool{}
+  for _, pat := range patterns {
+    matches, err := filepath.Glob(pat)
+    if err != nil {
+      return nil, nil, fmt.Errorf("invalid pattern %s", pat)
+    }
+    if len(matches) == 0 {
+      // keep missing files, they are reported as failures
+      matches = []string{pat}
+    }
+    for _, m := range matches {
+      if !seen[m] {
+        seen[m] = true
+        inputs = append(inputs, m)
+      }
+    }
+  }
+  return inputs, options, nil
+}
+
+// Name of the subject of an input file: the sub-<label> folder of a BIDS dataset, the
+// subject folder of a FreeSurfer subject (<subject>/mri/aseg.mgz) or the folder of the file.
+func subjectName( input string ) ( string ) {
+  parts := strings.Split(filepath.ToSlash(path.Clean(input)), "/")
+  for i := len(parts)-2; i >= 0; i-- {
+    if strings.HasPrefix(parts[i], "sub-") {
+      return parts[i]
+    }
+  }
+  if len(parts) > 2 && parts[len(parts)-2] == "mri" {
+    return parts[len(parts)-3]
+  }
+  if len(parts) > 1 {
+    return parts[len(parts)-2]
+  }
+  return stripExtension(parts[0])
+}
+
+// Run 'heat on' for each input as a separate process, at most jobs processes at the same time.
+// Options may contain {subject} which is replaced by the name of the subject (e.g. for --prefix).
+func runBatch( inputs []string, options []string, jobs int, verbose bool ) ( []batchResult ) {
+  exe, err := os.Executable()
+  if err != nil {
+    exe = os.Args[0]
+  }
+  tmpdir, err := ioutil.TempDir("", "heat-batch-")
+  if err != nil {
+    p(fmt.Sprintf("Error: could not create temporary directory"))
+    os.Exit(-1)
+  }
+  defer os.RemoveAll(tmpdir)
+
+  // share the processors between the jobs, the solver uses all of them otherwise
+  env := os.Environ()
+  if os.Getenv("GOMAXPROCS") == "" {
+    procs := runtime.NumCPU() / jobs
+    if procs < 1 {
+      procs = 1
+    }
+    env = append(env, fmt.Sprintf("GOMAXPROCS=%d", procs))
+  }
+
+  results := make([]batchResult, len(inputs))
+  slots := make(chan bool, jobs)
+  var wg sync.WaitGroup
+  var mu sync.Mutex
+  done := 0
+  for n, input := range inputs {
+    wg.Add(1)
+    slots <- true
+    go func( n int, input string ) {
+      defer wg.Done()
+      defer func() { <-slots }()
+      r := batchResult{subject: subjectName(input), input: input}
+      statsFile := path.Join(tmpdir, fmt.Sprintf("stats%d.json", n))
+      args := []string{"on", input, "--stats", statsFile}
+      for _, o := range options {
+        args = append(args, strings.Replace(o, "{subject}", r.subject, -1))
+      }
+      cmd := exec.Command(exe, args...)
+      cmd.Env = env
+      start := time.Now()
+      output, err := cmd.CombinedOutput()
+      r.seconds = time.Since(start).Seconds()
+
+      // 'on' reports most errors without an exit code, it succeeded if the stats were written
+      buf, serr := ioutil.ReadFile(statsFile)
+      if err == nil && serr == nil && json.Unmarshal(buf, &r.stats) == nil {
+        r.ok = true
+      } else if err != nil {
+        r.message = fmt.Sprintf("%s: %s", err, lastLine(output))
+      } else {
+        r.message = lastLine(output)
+      }
+      results[n] = r
+
+      mu.Lock()
+      done = done + 1
+      if verbose {
+        status := "ok"
+        if !r.ok {
+          status = "failed (" + r.message + ")"
+        }
+        p(fmt.Sprintf("[%d/%d] %s %s in %.1fs", done, len(inputs), r.subject, status, r.seconds))
+      }
+      mu.Unlock()
+    }(n, input)
+  }
+  wg.Wait()
+  return results
+}
+
+// last non-empty line of the output of a process, used as the error message
+func lastLine( output []byte ) ( string ) {
+  var last string
+  sc := bufio.NewScanner(bytes.NewReader(output))
+  for sc.Scan() {
+    if l := strings.TrimSpace(sc.Text()); l != "" {
+      last = l
+    }
+  }
+  if last == "" {
+    return "no output written"
+  }
+  return last
+}
+
+// save one line per subject with status, runtime and convergence of the solver
+func saveBatchSummary( results []batchResult, fn string, verbose bool ) {
+  if verbose {
+    p(fmt.Sprintf("writing file %s...", fn))
+  }
+  fi, err := os.Create(fn)
+  if err != nil {
+    p(fmt.Sprintf("Error: could not open file %s", fn))
+    os.Exit(-1)
+  }
+  defer fi.Close()
+  w := csv.NewWriter(fi)
+  defer w.Flush()
+  w.Write([]string{"subject", "input", "status", "seconds", "iterations", "residual", "message"})
+  for _, r := range results {
+    if r.ok {
+      w.Write([]string{r.subject, r.input, "ok", fmt.Sprintf("%.2f", r.seconds), fmt.Sprintf("%d", r.stats.Iterations), fmt.Sprintf("%g", r.stats.Residual), ""})
+    } else {
+      w.Write([]string{r.subject, r.input, "failed", fmt.Sprintf("%.2f", r.seconds), "", "", r.message})
+    }
+  }
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "path"
+  "path/filepath"
+  "strings"
+  "io/ioutil"
+  "encoding/json"
+)
+
+// BIDS desc entity of each output of the 'on' command. The shells are a discrete segmentation (dseg),
+// the other outputs keep the suffix of the input file.
+var bidsDescriptions = map[string]string{
+  "temperature": "temperature",
+  "label":       "shells",
+  "gradient":    "gradient",
+  "direction":   "direction",
+  "magnitude":   "magnitude",
+  "thickness":   "thickness",
+  "L0":          "L0",
+  "L1":          "L1",
+  "depth":       "depth",
+  "equivolume":  "equivolume",
+}
+
+// description of each output stored in its sidecar
+var outputDescriptions = map[string]string{
+  "temperature": "Solution of the heat equation between the temperatures of the temp0 and the temp1 boundary",
+  "label":       "Shells of equal volume between the temp0 and temp1 boundaries",
+  "gradient":    "Gradient of the temperature field per voxel (three frames)",
+  "direction":   "Unit length direction of the temperature gradient in mm (three frames)",
+  "magnitude":   "Magnitude of the temperature gradient per mm",
+  "thickness":   "Length of the path along the temperature gradient between the temp0 and temp1 boundaries in mm",
+  "L0":          "Length of the path along the temperature gradient from the temp0 boundary in mm",
+  "L1":          "Length of the path along the temperature gradient to the temp1 boundary in mm",
+  "depth":       "Normalized depth L0/(L0+L1), 0 at the temp0 boundary and 1 at the temp1 boundary",
+  "equivolume":  "Equivolumetric depth, fraction of the local volume between the temp0 boundary and the voxel",
+}
+
+// location of an input file in a BIDS dataset
+type bidsInput struct {
+  root     string // derivatives folder for the outputs (<dataset>/derivatives/heat)
+  subdir   string // sub-XX[/ses-YY]/<datatype>
+  entities string // entities of the input file name without desc and suffix
+  suffix   string // suffix of the input file name
+  source   string // input file relative to its dataset
+}
+
+// parse a BIDS style path like <dataset>/sub-XX/ses-YY/anat/sub-XX_ses-YY_dseg.nii.gz, inputs that are
+// part of a derivatives dataset (<dataset>/derivatives/<pipeline>/sub-XX/...) write to <dataset>/derivatives/heat
+func parseBIDSPath( fn string ) ( bidsInput, error ) {
+  var b bidsInput
+  abs, err := filepath.Abs(fn)
+  if err != nil {
+    return b, err
+  }
+  parts := strings.Split(filepath.ToSlash(abs), "/")
+  sub := -1
+  for i := len(parts)-2; i >= 0; i-- {
+    if strings.HasPrefix(parts[i], "sub-") {
+      sub = i
+      break
+    }
+  }
+  if sub < 0 {
+    return b, fmt.Errorf("%s is not part of a BIDS dataset (no sub-<label> folder)", fn)
+  }
+  dataset := strings.Join(parts[:sub], "/")
+  if path.Base(path.Dir(dataset)) == "derivatives" {
+    b.root = path.Join(path.Dir(dataset), "heat")
+  } else {
+    b.root = path.Join(dataset, "derivatives", "heat")
+  }
+  b.subdir = path.Join(parts[sub:len(parts)-1]...)
+  b.source = path.Join(parts[sub:]...)
+
+  // keep all entities of the file name but the description, the suffix is kept separately
+  tokens := strings.Split(stripExtension(parts[len(parts)-1]), "_")
+  if !strings.HasPrefix(tokens[0], "sub-") {
+    return b, fmt.Errorf("file name %s does not start with a sub-<label> entity", parts[len(parts)-1])
+  }
+  var entities []string
+  for _, t := range tokens[0:len(tokens)-1] {
+    if !strings.HasPrefix(t, "desc-") {
+      entities = append(entities, t)
+    }
+  }
+  b.suffix = tokens[len(tokens)-1]
+  if len(tokens) == 1 {
+    entities = tokens
+    b.suffix = "dseg"
+  }
+  b.entities = strings.Join(entities, "_")
+  return b, nil
+}
+
+// name of the sidecar file of an output (same name with .json extension)
+func sidecarName( fn string ) ( string ) {
+  return stripExtension(fn) + ".json"
+}
+
+// write the fields as a json sidecar next to the output file fn
+func writeSidecar( fn string, fields map[string]interface{}, verbose bool ) {
+  sc := sidecarName(fn)
+  if verbose {
+    p(fmt.Sprintf("writing file %s...", sc))
+  }
+  buf, err := json.MarshalIndent(fields, "", "  ")
+  if err != nil {
+    p(fmt.Sprintf("Error: could not encode sidecar %s (%s)", sc, err))
+    return
+  }
+  if err = ioutil.WriteFile(sc, append(buf, '\n'), 0644); err != nil {
+    p(fmt.Sprintf("Error: could not write file %s", sc))
+  }
+}
+
+// the dataset_description.json required for a BIDS derivatives dataset, an existing file is kept
+func writeDatasetDescription( root string, version string, verbose bool ) {
+  fn := path.Join(root, "dataset_description.json")
+  if _, err := os.Stat(fn); err == nil {
+    return
+  }
+  if err := os.MkdirAll(root, 0755); err != nil {
+    p(fmt.Sprintf("Error: could not create directory %s", root))
+    return
+  }
+  desc := map[string]interface{}{
+    "Name": "heat",
+    "BIDSVersion": "1.8.0",
+    "DatasetType": "derivative",
+    "GeneratedBy": []map[string]string{
+      {"Name": "heat", "Version": version, "CodeURL": "https://github.com/HaukeBartsch/heat"},
+    },
+  }
+  buf, _ := json.MarshalIndent(desc, "", "  ")
+  if verbose {
+    p(fmt.Sprintf("writing file %s...", fn))
+  }
+  if err := ioutil.WriteFile(fn, append(buf, '\n'), 0644); err != nil {
+    p(fmt.Sprintf("Error: could not write file %s", fn))
+  }
+}
+
+// name of the look-up table of the label output fn
+func shellsTSVName( fn string ) ( string ) {
+  return stripExtension(fn) + ".tsv"
+}
+
+// look-up table (index and name of each shell) for a BIDS discrete segmentation
+func writeShellsTSV( fn string, numShells int, flagged bool, verbose bool ) {
+  tsv := shellsTSVName(fn)
+  if verbose {
+    p(fmt.Sprintf("writing file %s...", tsv))
+  }
+  s := "index\tname\n"
+  for i := 1; i <= numShells; i++ {
+    s = s + fmt.Sprintf("%d\tshell-%d\n", i, i)
+  }
+  if flagged {
+    s = s + fmt.Sprintf("%d\tisolated\n", isolatedShell)
+  }
+  if err := ioutil.WriteFile(tsv, []byte(s), 0644); err != nil {
+    p(fmt.Sprintf("Error: could not write file %s", tsv))
+  }
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "strings"
+  "io/ioutil"
+  "encoding/json"
+  "github.com/codegangsta/cli"
+)
+
+// options to save the state of long simulations and to continue them later
+func checkpointFlags() ( []cli.Flag ) {
+  return []cli.Flag{
+    cli.IntFlag {
+      Name: "checkpoint-every",
+      Value: 0,
+      Usage: "Save the temperature field and the iteration every N iterations (and on SIGTERM/SIGINT)",
+    },
+    cli.StringFlag {
+      Name: "checkpoint",
+      Value: "",
+      Usage: "Checkpoint file (.mgz or .mgh), default is <base>_checkpoint.mgz in the output directory",
+    },
+    cli.BoolFlag {
+      Name: "resume",
+      Usage: "Continue the simulation from the checkpoint file if it exists",
+    },
+  }
+}
+
+// A checkpoint is the temperature field of all voxel together with a json sidecar that
+// stores the iteration, the checksum of the field and the settings, a checkpoint is only
+// resumed with the same settings.
+type checkpointInfo struct {
+  Iteration    int                `json:"Iteration"`
+  Field        string             `json:"FieldSHA256"`
+  Input        string             `json:"Input"`
+  SHA256       string             `json:"SHA256"`
+  Labels       map[string][]int   `json:"Labels"`
+  Temperatures map[string]float32 `json:"Temperatures"`
+  Stepsize     float64            `json:"Stepsize"`
+  Stencil      string             `json:"Stencil"`
+  Preprocessing []string          `json:"Preprocessing,omitempty"`
+  Masks        map[string][2]string `json:"Masks,omitempty"` // path and SHA256 of each mask
+  Source       interface{}        `json:"Source,omitempty"`   // source term of the Poisson equation
+}
+
+type checkpointer struct {
+  fn string
+  head header
+  info checkpointInfo
+  verbose bool
+}
+
+func newCheckpointer( fn string, head header, prov provenance, temp0 []int, temp1 []int, sim []int, omega float64, stencil string, verbose bool ) ( *checkpointer ) {
+  return &checkpointer{fn: fn, head: head, verbose: verbose, info: checkpointInfo{
+    Input: prov.input,
+    SHA256: prov.checksum,
+    Labels: map[string][]int{"temp0": temp0, "temp1": temp1, "simulate": sim},
+    Temperatures: map[string]float32{"temp0": lowTemperature, "temp1": highTemperature},
+    Stepsize: omega,
+    Stencil: stencil,
+  }}
+}
+
+// checkpoint files need to be mgh files
+func checkCheckpointName( fn string ) ( error ) {
+  if !strings.HasSuffix(fn, ".mgz") && !strings.HasSuffix(fn, ".mgh") {
+    return fmt.Errorf("checkpoint file %s has to end in .mgz or .mgh", fn)
+  }
+  return nil
+}
+
+// Save the field and the iteration. Both are written to temporary files first and renamed
+// afterwards so that a job killed while writing does not destroy the previous checkpoint. The
+// sidecar is written after the field and contains its checksum, a job killed between the two
+// renames leaves a field that does not match the sidecar.
+func (cp *checkpointer) save( field [][][]float32, iteration int ) {
+  ext := cp.fn[len(cp.fn)-4:]
+  tmp := stripExtension(cp.fn) + ".tmp" + ext
+  if cp.verbose {
+    fmt.Printf("\n")
+    p(fmt.Sprintf("checkpoint at iteration %d", iteration))
+  }
+  saveMGH(field, tmp, cp.head, cp.verbose)
+  cp.info.Iteration = iteration
+  cp.info.Field = fileSHA256(tmp)
+  if err := os.Rename(tmp, cp.fn); err != nil {
+    p(fmt.Sprintf("Error: could not write checkpoint %s", cp.fn))
+    return
+  }
+  buf, _ := json.MarshalIndent(cp.info, "", "  ")
+  if err := ioutil.WriteFile(sidecarName(tmp), append(buf, '\n'), 0644); err != nil {
+    p(fmt.Sprintf("Error: could not write file %s", sidecarName(tmp)))
+    return
+  }
+  if err := os.Rename(sidecarName(tmp), sidecarName(cp.fn)); err != nil {
+    p(fmt.Sprintf("Error: could not write checkpoint %s", sidecarName(cp.fn)))
+  }
+}
+
+// Read the checkpoint if it exists, returns the field and the iteration. It is an error
+// if the checkpoint was created for another input or with other settings.
+func (cp *checkpointer) load() ( [][][]float32, int, error ) {
+  buf, err := ioutil.ReadFile(sidecarName(cp.fn))
+  if os.IsNotExist(err) {
+    return nil, 0, nil
+  }
+  if err != nil {
+    return nil, 0, fmt.Errorf("could not read checkpoint %s", sidecarName(cp.fn))
+  }
+  var info checkpointInfo
+  if err := json.Unmarshal(buf, &info); err != nil {
+    return nil, 0, fmt.Errorf("could not parse checkpoint %s (%s)", sidecarName(cp.fn), err)
+  }
+  want, _ := json.Marshal(checkpointInfo{SHA256: cp.info.SHA256, Labels: cp.info.Labels, Temperatures: cp.info.Temperatures, Stepsize: cp.info.Stepsize, Stencil: cp.info.Stencil,
+    Preprocessing: cp.info.Preprocessing, Masks: cp.info.Masks, Source: cp.info.Source})
+  got, _ := json.Marshal(checkpointInfo{SHA256: info.SHA256, Labels: info.Labels, Temperatures: info.Temperatures, Stepsize: info.Stepsize, Stencil: info.Stencil,
+    Preprocessing: info.Preprocessing, Masks: info.Masks, Source: info.Source})
+  if string(want) != string(got) {
+    return nil, 0, fmt.Errorf("checkpoint %s was created for another input or with other labels, temperatures, stepsize, stencil, preprocessing, masks or source", cp.fn)
+  }
+  if fileSHA256(cp.fn) != info.Field {
+    return nil, 0, fmt.Errorf("checkpoint %s does not match its sidecar, the job was stopped while saving it (remove both files to start again)", cp.fn)
+  }
+  field, head := readMGHfloat(cp.fn, cp.verbose)
+  if !sameDimensions(head, cp.head) {
+    return nil, 0, fmt.Errorf("checkpoint %s and the label field have different dimensions", cp.fn)
+  }
+  return field, info.Iteration, nil
+}
+
+// remove the checkpoint after the simulation finished
+func (cp *checkpointer) remove() {
+  os.Remove(sidecarName(cp.fn))
+  os.Remove(cp.fn)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+  "fmt"
+)
+
+// neighborhood offsets (dk, dj, di) for 6, 18 and 26 connectivity
+func neighborOffsets( connectivity int ) ( [][3]int ) {
+  var offsets [][3]int
+  for dk := -1; dk <= 1; dk++ {
+    for dj := -1; dj <= 1; dj++ {
+      for di := -1; di <= 1; di++ {
+        n := dk*dk + dj*dj + di*di
+        if n == 0 {
+          continue
+        }
+        if connectivity == 6 && n > 1 {
+          continue
+        }
+        if connectivity == 18 && n > 2 {
+          continue
+        }
+        offsets = append(offsets, [3]int{dk, dj, di})
+      }
+    }
+  }
+  return offsets
+}
+
+// label the connected components of all voxel with mask != 0, returns a field
+// with component numbers (1..N, 0 for background) and the number of components N
+func connectedComponents( mask [][][]uint8, connectivity int ) ( [][][]int32, int ) {
+  var dims [3]int
+  dims[2] = len(mask)
+  dims[1] = len(mask[0])
+  dims[0] = len(mask[0][0])
+  comp := make([][][]int32, dims[2])
+  for i := range comp {
+    comp[i] = make([][]int32, dims[1])
+    for j := range comp[i] {
+      comp[i][j] = make([]int32, dims[0])
+    }
+  }
+
+  offsets := neighborOffsets(connectivity)
+  n := 0
+  var queue [][3]int
+  for k := 0; k < dims[2]; k++ {
+    for j := 0; j < dims[1]; j++ {
+      for i := 0; i < dims[0]; i++ {
+        if mask[k][j][i] == 0 || comp[k][j][i] != 0 {
+          continue
+        }
+        // flood fill a new component starting at this voxel
+        n = n + 1
+        comp[k][j][i] = int32(n)
+        queue = append(queue[:0], [3]int{k, j, i})
+        for len(queue) > 0 {
+          v := queue[len(queue)-1]
+          queue = queue[:len(queue)-1]
+          for _, o := range offsets {
+            kk := v[0] + o[0]
+            jj := v[1] + o[1]
+            ii := v[2] + o[2]
+            if kk < 0 || jj < 0 || ii < 0 || kk >= dims[2] || jj >= dims[1] || ii >= dims[0] {
+              continue
+            }
+            if mask[kk][jj][ii] == 0 || comp[kk][jj][ii] != 0 {
+              continue
+            }
+            comp[kk][jj][ii] = int32(n)
+            queue = append(queue, [3]int{kk, jj, ii})
+          }
+        }
+      }
+    }
+  }
+  return comp, n
+}
+
+// what happens to simulated components that touch neither boundary (--isolated)
+var isolatedActions = []string{"keep", "drop", "flag"}
+
+// shell label of the voxel of isolated components with --isolated flag
+const isolatedShell uint8 = 255
+
+// a connected component of the simulated voxel
+type simulatedComponent struct {
+  voxels int
+  temp0, temp1 bool // touches the temp0 or temp1 boundary
+}
+
+// Connected components of the simulated voxel (mask are the classes of classifyVoxels) and the
+// boundaries they touch. Heat only flows between neighbors of the stencil, the connectivity should
+// be the one of the stencil. Components that touch neither boundary never change their initial
+// temperature.
+func simulatedComponents( mask [][][]uint8, connectivity int ) ( [][][]int32, []simulatedComponent ) {
+  sim := make([][][]uint8, len(mask))
+  for k := range mask {
+    sim[k] = make([][]uint8, len(mask[k]))
+    for j := range mask[k] {
+      sim[k][j] = make([]uint8, len(mask[k][j]))
+      for i := range mask[k][j] {
+        if mask[k][j][i] == maskSimulate {
+          sim[k][j][i] = 1
+        }
+      }
+    }
+  }
+  comp, n := connectedComponents(sim, connectivity)
+  components := make([]simulatedComponent, n)
+  offsets := neighborOffsets(connectivity)
+  for k := range comp {
+    for j := range comp[k] {
+      for i := range comp[k][j] {
+        if comp[k][j][i] == 0 {
+          continue
+        }
+        sc := &components[comp[k][j][i]-1]
+        sc.voxels = sc.voxels + 1
+        for _, o := range offsets {
+          kk, jj, ii := k+o[0], j+o[1], i+o[2]
+          if kk < 0 || jj < 0 || ii < 0 || kk >= len(mask) || jj >= len(mask[0]) || ii >= len(mask[0][0]) {
+            continue
+          }
+          switch mask[kk][jj][ii] {
+          case maskTemp0:
+            sc.temp0 = true
+          case maskTemp1:
+            sc.temp1 = true
+          }
+        }
+      }
+    }
+  }
+  return comp, components
+}
+
+// Print the components of the simulated region (all in verbose mode, otherwise only a warning for
+// isolated components) and return a summary for the sidecars.
+func reportComponents( components []simulatedComponent, action string, verbose bool ) ( map[string]interface{} ) {
+  var both, only0, only1, isolated, isolatedVoxels int
+  for n, sc := range components {
+    touches := "temp0 and temp1"
+    switch {
+    case sc.temp0 && sc.temp1:
+      both = both + 1
+    case sc.temp0:
+      only0 = only0 + 1
+      touches = "temp0 only"
+    case sc.temp1:
+      only1 = only1 + 1
+      touches = "temp1 only"
+    default:
+      isolated = isolated + 1
+      isolatedVoxels = isolatedVoxels + sc.voxels
+      touches = "neither boundary"
+    }
+    if verbose {
+      p(fmt.Sprintf("simulated component %d: %d voxel, touches %s", n+1, sc.voxels, touches))
+    }
+  }
+  if isolated > 0 && action == "keep" {
+    p(fmt.Sprintf("Warning: %d of %d simulated components (%d voxel) touch neither boundary, use --isolated drop or flag", isolated, len(components), isolatedVoxels))
+  } else if isolated > 0 && verbose {
+    p(fmt.Sprintf("%s %d isolated components (%d voxel)", action, isolated, isolatedVoxels))
+  }
+  return map[string]interface{}{
+    "Count": len(components),
+    "TouchingBoth": both,
+    "TouchingTemp0Only": only0,
+    "TouchingTemp1Only": only1,
+    "Isolated": isolated,
+    "IsolatedVoxels": isolatedVoxels,
+    "IsolatedAction": action,
+  }
+}
+
+// Remove the voxel of components that touch neither boundary from the simulation (repulsive
+// boundary like other labels), returns the removed voxel.
+func excludeIsolated( mask [][][]uint8, comp [][][]int32, components []simulatedComponent ) ( [][][]bool ) {
+  isolated := make([][][]bool, len(mask))
+  for k := range mask {
+    isolated[k] = make([][]bool, len(mask[k]))
+    for j := range mask[k] {
+      isolated[k][j] = make([]bool, len(mask[k][j]))
+      for i := range mask[k][j] {
+        if c := comp[k][j][i]; c > 0 && !components[c-1].temp0 && !components[c-1].temp1 {
+          isolated[k][j][i] = true
+          mask[k][j][i] = maskOther
+        }
+      }
+    }
+  }
+  return isolated
+}
+
+// mark the voxel of isolated components in the shell label field
+func flagIsolated( label [][][]uint8, isolated [][][]bool ) {
+  for k := range isolated {
+    for j := range isolated[k] {
+      for i := range isolated[k][j] {
+        if isolated[k][j][i] {
+          label[k][j][i] = isolatedShell
+        }
+      }
+    }
+  }
+}
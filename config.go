@@ -0,0 +1,231 @@
+package main
+
+import (
+  "fmt"
+  "bytes"
+  "strings"
+  "io/ioutil"
+  "encoding/json"
+  "gopkg.in/yaml.v2"
+  "github.com/codegangsta/cli"
+)
+
+// A run of the 'on' command described in a yaml or json file (--config), for example:
+//
+//   input: aseg.mgz
+//   temp0: { labels: [42], temperature: 0.01 }
+//   temp1: { labels: [Right-Caudate, 43, 77, 63, 44], temperature: 0.1 }
+//   simulate: [41, 51, 52, 49, 62, 53, 54, 58]
+//   preprocess: { merge: ["77:2"], fill_holes: [2] }
+//   solver: { stepsize: 0.12, iterations: 200, scheme: central }
+//   outputs: { label: 3, thickness: true, outdir: derivatives/heat }
+type runConfig struct {
+  Input    string         `yaml:"input" json:"input"`
+  Preset   string         `yaml:"preset" json:"preset"`
+  Temp0    boundaryConfig `yaml:"temp0" json:"temp0"`
+  Temp1    boundaryConfig `yaml:"temp1" json:"temp1"`
+  Simulate labelList      `yaml:"simulate" json:"simulate"`
+  Masks    maskConfig     `yaml:"masks" json:"masks"`
+  Preprocess preprocessConfig `yaml:"preprocess" json:"preprocess"`
+  Solver   solverConfig   `yaml:"solver" json:"solver"`
+  Outputs  outputConfig   `yaml:"outputs" json:"outputs"`
+  Lut      string         `yaml:"lut" json:"lut"`
+}
+
+// labels with a fixed temperature
+type boundaryConfig struct {
+  Labels      labelList `yaml:"labels" json:"labels"`
+  Temperature *float64  `yaml:"temperature" json:"temperature"`
+}
+
+// binary masks of the regions (see maskFlags)
+type maskConfig struct {
+  Temp0    string `yaml:"temp0" json:"temp0"`
+  Temp1    string `yaml:"temp1" json:"temp1"`
+  Simulate string `yaml:"simulate" json:"simulate"`
+}
+
+// edits of the label field before the simulation (see preprocessFlags)
+type preprocessConfig struct {
+  Merge        []string  `yaml:"merge" json:"merge"`
+  FillHoles    labelList `yaml:"fill_holes" json:"fill_holes"`
+  MaxHole      *int      `yaml:"max_hole" json:"max_hole"`
+  MinComponent *int      `yaml:"min_component" json:"min_component"`
+  Erode        []string  `yaml:"erode" json:"erode"`
+  Dilate       []string  `yaml:"dilate" json:"dilate"`
+}
+
+type solverConfig struct {
+  Method     string   `yaml:"method" json:"method"`
+  Stepsize   *float64 `yaml:"stepsize" json:"stepsize"`
+  Iterations *int     `yaml:"iterations" json:"iterations"`
+  Scheme     string   `yaml:"scheme" json:"scheme"`
+  Stencil    string   `yaml:"stencil" json:"stencil"`
+  Upsample   *int     `yaml:"upsample" json:"upsample"`
+  Crop       *bool    `yaml:"crop" json:"crop"`
+  CropMargin *int     `yaml:"crop_margin" json:"crop_margin"`
+  Isolated   string   `yaml:"isolated" json:"isolated"`
+  Init       string   `yaml:"init" json:"init"`
+  Start      string   `yaml:"start" json:"start"`
+  Source     string   `yaml:"source" json:"source"`
+}
+
+// requested outputs, the names are the same as the command line options
+type outputConfig struct {
+  Label     *int   `yaml:"label" json:"label"`
+  Gradient  bool   `yaml:"gradient" json:"gradient"`
+  Direction bool   `yaml:"direction" json:"direction"`
+  Magnitude bool   `yaml:"magnitude" json:"magnitude"`
+  Thickness bool   `yaml:"thickness" json:"thickness"`
+  Outdir    string `yaml:"outdir" json:"outdir"`
+  Prefix    string `yaml:"prefix" json:"prefix"`
+  Bids      bool   `yaml:"bids" json:"bids"`
+}
+
+// read a run configuration, files ending in .json are parsed as json, all others as yaml
+func readConfig( fn string ) ( runConfig, error ) {
+  var cfg runConfig
+  buf, err := ioutil.ReadFile(fn)
+  if err != nil {
+    return cfg, fmt.Errorf("could not read config file %s", fn)
+  }
+  if strings.HasSuffix(fn, ".json") {
+    dec := json.NewDecoder(bytes.NewReader(buf))
+    dec.DisallowUnknownFields()
+    err = dec.Decode(&cfg)
+  } else {
+    err = yaml.UnmarshalStrict(buf, &cfg)
+  }
+  if err != nil {
+    return cfg, fmt.Errorf("could not parse config file %s (%s)", fn, err)
+  }
+  return cfg, nil
+}
+
+// values of the config file for each command line option, options without a value are not listed
+func (cfg runConfig) flagValues() ( map[string][]string ) {
+  v := map[string][]string{}
+  if cfg.Preset != "" {
+    v["preset"] = []string{cfg.Preset}
+  }
+  v["temp0"] = cfg.Temp0.Labels
+  v["temp1"] = cfg.Temp1.Labels
+  v["simulate"] = cfg.Simulate
+  if cfg.Temp0.Temperature != nil {
+    v["temp0-value"] = []string{fmt.Sprintf("%g", *cfg.Temp0.Temperature)}
+  }
+  if cfg.Temp1.Temperature != nil {
+    v["temp1-value"] = []string{fmt.Sprintf("%g", *cfg.Temp1.Temperature)}
+  }
+  masks := map[string]string{"temp0-mask": cfg.Masks.Temp0, "temp1-mask": cfg.Masks.Temp1, "simulate-mask": cfg.Masks.Simulate}
+  for name, fn := range masks {
+    if fn != "" {
+      v[name] = []string{fn}
+    }
+  }
+  v["merge"] = cfg.Preprocess.Merge
+  v["fill-holes"] = cfg.Preprocess.FillHoles
+  if cfg.Preprocess.MaxHole != nil {
+    v["max-hole"] = []string{fmt.Sprintf("%d", *cfg.Preprocess.MaxHole)}
+  }
+  if cfg.Preprocess.MinComponent != nil {
+    v["min-component"] = []string{fmt.Sprintf("%d", *cfg.Preprocess.MinComponent)}
+  }
+  v["erode"] = cfg.Preprocess.Erode
+  v["dilate"] = cfg.Preprocess.Dilate
+  if cfg.Solver.Method != "" {
+    v["method"] = []string{cfg.Solver.Method}
+  }
+  if cfg.Solver.Stepsize != nil {
+    v["stepsize"] = []string{fmt.Sprintf("%g", *cfg.Solver.Stepsize)}
+  }
+  if cfg.Solver.Iterations != nil {
+    v["iterations"] = []string{fmt.Sprintf("%d", *cfg.Solver.Iterations)}
+  }
+  if cfg.Solver.Scheme != "" {
+    v["scheme"] = []string{cfg.Solver.Scheme}
+  }
+  if cfg.Solver.Stencil != "" {
+    v["stencil"] = []string{cfg.Solver.Stencil}
+  }
+  if cfg.Solver.Upsample != nil {
+    v["upsample"] = []string{fmt.Sprintf("%d", *cfg.Solver.Upsample)}
+  }
+  if cfg.Solver.Crop != nil && !*cfg.Solver.Crop {
+    v["no-crop"] = []string{"true"}
+  }
+  if cfg.Solver.CropMargin != nil {
+    v["crop-margin"] = []string{fmt.Sprintf("%d", *cfg.Solver.CropMargin)}
+  }
+  if cfg.Solver.Isolated != "" {
+    v["isolated"] = []string{cfg.Solver.Isolated}
+  }
+  if cfg.Solver.Start != "" {
+    v["start"] = []string{cfg.Solver.Start}
+  }
+  if cfg.Solver.Source != "" {
+    v["source"] = []string{cfg.Solver.Source}
+  }
+  if cfg.Solver.Init != "" {
+    v["init"] = []string{cfg.Solver.Init}
+  }
+  if cfg.Outputs.Label != nil {
+    v["label"] = []string{fmt.Sprintf("%d", *cfg.Outputs.Label)}
+  }
+  bools := map[string]bool{"gradient": cfg.Outputs.Gradient, "direction": cfg.Outputs.Direction,
+    "magnitude": cfg.Outputs.Magnitude, "thickness": cfg.Outputs.Thickness, "bids": cfg.Outputs.Bids}
+  for name, b := range bools {
+    if b {
+      v[name] = []string{"true"}
+    }
+  }
+  if cfg.Lut != "" {
+    v["lut"] = []string{cfg.Lut}
+  }
+  if cfg.Outputs.Outdir != "" {
+    v["outdir"] = []string{cfg.Outputs.Outdir}
+  }
+  if cfg.Outputs.Prefix != "" {
+    v["prefix"] = []string{cfg.Outputs.Prefix}
+  }
+  return v
+}
+
+// Apply the config file given by --config to the options of the command, options given
+// on the command line take precedence. Returns the input file of the config file.
+func applyConfig( c *cli.Context ) ( string, error ) {
+  if c.String("config") == "" {
+    return "", nil
+  }
+  cfg, err := readConfig(c.String("config"))
+  if err != nil {
+    return "", err
+  }
+  for name, values := range cfg.flagValues() {
+    if isSet(c, name) {
+      continue
+    }
+    for _, val := range values {
+      if err := c.Set(name, val); err != nil {
+        return "", fmt.Errorf("invalid value %s for %s in config file %s", val, name, c.String("config"))
+      }
+    }
+  }
+  return cfg.Input, nil
+}
+
+// true if the option or one of its alternative names (e.g. --t0 for --temp0) was given
+func isSet( c *cli.Context, name string ) ( bool ) {
+  for _, f := range c.Command.Flags {
+    names := strings.Split(f.GetName(), ",")
+    if !contains(names, name) {
+      continue
+    }
+    for _, n := range names {
+      if c.IsSet(strings.TrimSpace(n)) {
+        return true
+      }
+    }
+  }
+  return c.IsSet(name)
+}
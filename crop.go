@@ -0,0 +1,120 @@
+package main
+
+// Bounding box (voxel i, j, k) of all voxel with one of the labels in lists, enlarged by margin
+// voxel and limited to the volume. lo is the first and hi the last voxel inside the box, ok is
+// false if none of the labels exists.
+func boundingBox( labels [][][]uint8, margin int, lists ...[]int ) ( [3]int, [3]int, bool ) {
+  var use [256]bool
+  for _, list := range lists {
+    for _, l := range list {
+      if l >= 0 && l < 256 {
+        use[l] = true
+      }
+    }
+  }
+  dims := [3]int{len(labels[0][0]), len(labels[0]), len(labels)}
+  lo := dims
+  hi := [3]int{-1, -1, -1}
+  for k := range labels {
+    for j := range labels[k] {
+      for i := range labels[k][j] {
+        if !use[labels[k][j][i]] {
+          continue
+        }
+        for c, v := range [3]int{i, j, k} {
+          if v < lo[c] {
+            lo[c] = v
+          }
+          if v > hi[c] {
+            hi[c] = v
+          }
+        }
+      }
+    }
+  }
+  if hi[0] < 0 {
+    return lo, hi, false
+  }
+  for c := 0; c < 3; c++ {
+    lo[c] = lo[c] - margin
+    if lo[c] < 0 {
+      lo[c] = 0
+    }
+    hi[c] = hi[c] + margin
+    if hi[c] > dims[c]-1 {
+      hi[c] = dims[c]-1
+    }
+  }
+  return lo, hi, true
+}
+
+// the voxel lo..hi of the label field
+func cropLabels( labels [][][]uint8, lo [3]int, hi [3]int ) ( [][][]uint8 ) {
+  out := make([][][]uint8, hi[2]-lo[2]+1)
+  for k := range out {
+    out[k] = make([][]uint8, hi[1]-lo[1]+1)
+    for j := range out[k] {
+      out[k][j] = make([]uint8, hi[0]-lo[0]+1)
+      copy(out[k][j], labels[lo[2]+k][lo[1]+j][lo[0]:hi[0]+1])
+    }
+  }
+  return out
+}
+
+// Geometry of the voxel lo..hi, the center of the cropped volume (dims/2) is the new Pxyz.
+func cropHeader( head header, lo [3]int, hi [3]int ) ( header ) {
+  m := vox2ras(head)
+  crop := explicitGeometry(head)
+  crop.width = int32(hi[0]-lo[0]+1)
+  crop.height = int32(hi[1]-lo[1]+1)
+  crop.depth = int32(hi[2]-lo[2]+1)
+  center := [3]float32{float32(lo[0]) + float32(crop.width)/2, float32(lo[1]) + float32(crop.height)/2, float32(lo[2]) + float32(crop.depth)/2}
+  for r := 0; r < 3; r++ {
+    crop.Pxyz[r] = m[r][3]
+    for c := 0; c < 3; c++ {
+      crop.Pxyz[r] = crop.Pxyz[r] + m[r][c]*center[c]
+    }
+  }
+  return crop
+}
+
+// Place the field of a cropped grid (frames interleaved values per voxel) at voxel offset of a volume
+// with the dimensions of head, all other voxel are zero.
+func pasteField( field [][][]float32, head header, offset [3]int, frames int ) ( [][][]float32 ) {
+  if len(field) == int(head.depth) && len(field[0]) == int(head.height) && len(field[0][0]) == int(head.width)*frames {
+    return field
+  }
+  out := make([][][]float32, head.depth)
+  for k := range out {
+    out[k] = make([][]float32, head.height)
+    for j := range out[k] {
+      out[k][j] = make([]float32, int(head.width)*frames)
+    }
+  }
+  for k := range field {
+    for j := range field[k] {
+      copy(out[offset[2]+k][offset[1]+j][offset[0]*frames:], field[k][j])
+    }
+  }
+  return out
+}
+
+// pasteField for label fields
+func pasteLabels( field [][][]uint8, head header, offset [3]int ) ( [][][]uint8 ) {
+  if len(field) == int(head.depth) && len(field[0]) == int(head.height) && len(field[0][0]) == int(head.width) {
+    return field
+  }
+  out := make([][][]uint8, head.depth)
+  for k := range out {
+    out[k] = make([][]uint8, head.height)
+    for j := range out[k] {
+      out[k][j] = make([]uint8, head.width)
+    }
+  }
+  for k := range field {
+    for j := range field[k] {
+      copy(out[offset[2]+k][offset[1]+j][offset[0]:], field[k][j])
+    }
+  }
+  return out
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "time"
+)
+
+// 1D squared distance transform of the sampled function f with sample spacing s (Felzenszwalb and
+// Huttenlocher, 2012), d is the lower envelope of the parabolas (x-x_q)^2 + f(q)
+func distanceTransform1D( f []float64, s float64, d []float64, v []int, z []float64 ) {
+  n := len(f)
+  k := -1
+  for q := 0; q < n; q++ {
+    if math.IsInf(f[q], 1) {
+      continue
+    }
+    xq := float64(q)*s
+    for k >= 0 {
+      xv := float64(v[k])*s
+      sp := ((f[q] + xq*xq) - (f[v[k]] + xv*xv)) / (2*(xq - xv))
+      if sp <= z[k] {
+        k = k - 1
+        continue
+      }
+      k = k + 1
+      v[k] = q
+      z[k] = sp
+      break
+    }
+    if k < 0 {
+      k = 0
+      v[0] = q
+      z[0] = math.Inf(-1)
+    }
+    z[k+1] = math.Inf(1)
+  }
+  if k < 0 {
+    for q := range d {
+      d[q] = math.Inf(1)
+    }
+    return
+  }
+  j := 0
+  for q := 0; q < n; q++ {
+    x := float64(q)*s
+    for z[j+1] < x {
+      j = j + 1
+    }
+    dx := x - float64(v[j])*s
+    d[q] = dx*dx + f[v[j]]
+  }
+}
+
+// Exact Euclidean distance (mm) of each voxel to the closest voxel with seed set, vz is the
+// voxel size. Volumes without seed voxel have an infinite distance everywhere.
+func euclideanDistance( seed [][][]bool, vz [3]float32 ) ( [][][]float32 ) {
+  var dims [3]int
+  dims[2] = len(seed)
+  dims[1] = len(seed[0])
+  dims[0] = len(seed[0][0])
+  g := make([]float64, dims[0]*dims[1]*dims[2])
+  for k := 0; k < dims[2]; k++ {
+    for j := 0; j < dims[1]; j++ {
+      for i := 0; i < dims[0]; i++ {
+        if seed[k][j][i] {
+          g[(k*dims[1]+j)*dims[0]+i] = 0
+        } else {
+          g[(k*dims[1]+j)*dims[0]+i] = math.Inf(1)
+        }
+      }
+    }
+  }
+  // transform along each axis, strides of the axes in g
+  stride := [3]int{1, dims[0], dims[0]*dims[1]}
+  maxDim := dims[0]
+  if dims[1] > maxDim {
+    maxDim = dims[1]
+  }
+  if dims[2] > maxDim {
+    maxDim = dims[2]
+  }
+  f := make([]float64, maxDim)
+  d := make([]float64, maxDim)
+  v := make([]int, maxDim)
+  z := make([]float64, maxDim+1)
+  for axis := 0; axis < 3; axis++ {
+    n := dims[axis]
+    a, b := (axis+1)%3, (axis+2)%3
+    for p := 0; p < dims[a]; p++ {
+      for q := 0; q < dims[b]; q++ {
+        start := p*stride[a] + q*stride[b]
+        for x := 0; x < n; x++ {
+          f[x] = g[start + x*stride[axis]]
+        }
+        distanceTransform1D(f[0:n], float64(vz[axis]), d[0:n], v, z)
+        for x := 0; x < n; x++ {
+          g[start + x*stride[axis]] = d[x]
+        }
+      }
+    }
+  }
+  dist := make([][][]float32, dims[2])
+  for k := range dist {
+    dist[k] = make([][]float32, dims[1])
+    for j := range dist[k] {
+      dist[k][j] = make([]float32, dims[0])
+      for i := range dist[k][j] {
+        dist[k][j][i] = float32(math.Sqrt(g[(k*dims[1]+j)*dims[0]+i]))
+      }
+    }
+  }
+  return dist
+}
+
+// seed voxel of the given class in the mask (see classifyVoxels)
+func maskClass( mask [][][]uint8, class uint8 ) ( [][][]bool ) {
+  seed := make([][][]bool, len(mask))
+  for k := range mask {
+    seed[k] = make([][]bool, len(mask[k]))
+    for j := range mask[k] {
+      seed[k][j] = make([]bool, len(mask[k][j]))
+      for i := range mask[k][j] {
+        seed[k][j][i] = mask[k][j][i] == class
+      }
+    }
+  }
+  return seed
+}
+
+// voxel size used for distances, volumes without geometry have 1mm voxel
+func voxelSize( head header ) ( [3]float32 ) {
+  if head.goodRASFlag == 1 {
+    return head.vz
+  }
+  return [3]float32{1, 1, 1}
+}
+
+// Temperatures from the distances d0 and d1 to the temp0 and temp1 boundaries, T = T0 + (T1-T0) d0/(d0+d1).
+// Simulated voxel that can not be reached from both boundaries get the mean temperature. Boundary voxel
+// have their fixed temperature if showAllTemps is set, all other voxel are zero.
+func temperatureFromDistances( d0 [][][]float32, d1 [][][]float32, mask [][][]uint8, showAllTemps bool ) ( [][][]float32 ) {
+  field := make([][][]float32, len(mask))
+  for k := range field {
+    field[k] = make([][]float32, len(mask[k]))
+    for j := range field[k] {
+      field[k][j] = make([]float32, len(mask[k][j]))
+      for i := range field[k][j] {
+        switch mask[k][j][i] {
+        case maskSimulate:
+          a := float64(d0[k][j][i])
+          b := float64(d1[k][j][i])
+          if math.IsInf(a, 0) || math.IsInf(b, 0) || a+b == 0 {
+            field[k][j][i] = lowTemperature + (highTemperature-lowTemperature)/2.0
+          } else {
+            field[k][j][i] = lowTemperature + (highTemperature-lowTemperature)*float32(a/(a+b))
+          }
+        case maskTemp0:
+          if showAllTemps {
+            field[k][j][i] = lowTemperature
+          }
+        case maskTemp1:
+          if showAllTemps {
+            field[k][j][i] = highTemperature
+          }
+        }
+      }
+    }
+  }
+  return field
+}
+
+// initial temperatures of the simulation from the Euclidean distances to both boundaries (--start distance),
+// a good approximation of the solution in thin structures
+func distanceInitialField( mask [][][]uint8, head header ) ( [][][]float32 ) {
+  vz := voxelSize(head)
+  d0 := euclideanDistance(maskClass(mask, maskTemp0), vz)
+  d1 := euclideanDistance(maskClass(mask, maskTemp1), vz)
+  return temperatureFromDistances(d0, d1, mask, true)
+}
+
+// methods of the 'on' command to compute the depth between the two boundaries
+var depthMethods = []string{"heat", "equivolume", "euclidean", "geodesic"}
+
+// methods that solve the heat equation (the others compute distances)
+func simulatedMethod( method string ) ( bool ) {
+  return method == "heat" || method == "equivolume"
+}
+
+// Depth field of the euclidean or geodesic method normalized to the boundary temperatures like the
+// solution of the heat equation, mask is the class of each voxel (see classifyVoxels). Euclidean
+// distances ignore all other labels, geodesic distances are measured inside the simulated voxel
+// (fast marching). Returns the field, the mask and the runtime.
+func distanceMethod( method string, mask [][][]uint8, head header, showAllTemps bool, verbose bool ) ( [][][]float32, [][][]uint8, solverStats ) {
+  var stats solverStats
+  begin := time.Now()
+  vz := voxelSize(head)
+  var d0, d1 [][][]float32
+  if method == "geodesic" {
+    d0 = geodesicDistance(mask, maskTemp0, vz)
+    d1 = geodesicDistance(mask, maskTemp1, vz)
+  } else {
+    d0 = euclideanDistance(maskClass(mask, maskTemp0), vz)
+    d1 = euclideanDistance(maskClass(mask, maskTemp1), vz)
+  }
+  field := temperatureFromDistances(d0, d1, mask, showAllTemps)
+  stats.elapsed = time.Since(begin)
+  if verbose {
+    p(fmt.Sprintf("%s distances computed in %s", method, stats.elapsed.String()))
+  }
+  return field, mask, stats
+}
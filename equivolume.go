@@ -0,0 +1,81 @@
+package main
+
+import (
+  "fmt"
+  "math"
+)
+
+// Equivolumetric depth (Bok 1929, Waehnert et al. 2014) of each simulated voxel. The streamlines of the
+// Laplace solution form tubes with a constant heat flux, the cross-section of a tube is therefore
+// proportional to 1/|grad T|. The volume of the tube between the temp0 boundary and a voxel (V0) and
+// between the voxel and the temp1 boundary (V1) are path integrals of 1/|grad T| along the streamline,
+// solved by the same upwind iterations as the thickness. The depth V0/(V0+V1) is the fraction of the
+// local volume below the voxel, shells of constant depth keep their volume fraction also in curved regions.
+// This is a single pass, the tubes are not recomputed from the streamlines of the resulting depth.
+func equivolumeDepth( gradient [][][]float32, mask [][][]uint8, head header, verbose bool ) ( [][][]float32 ) {
+  var dims [3]int
+  dims[2] = len(mask)
+  dims[1] = len(mask[0])
+  dims[0] = len(mask[0][0])
+  vz := voxelSize(head)
+
+  v0 := make([][][]float32, dims[2])
+  v1 := make([][][]float32, dims[2])
+  for k := range v0 {
+    v0[k] = make([][]float32, dims[1])
+    v1[k] = make([][]float32, dims[1])
+    for j := range v0[k] {
+      v0[k][j] = make([]float32, dims[0])
+      v1[k][j] = make([]float32, dims[0])
+    }
+  }
+
+  // the weight is the cross-section relative to the mean cross-section so that the
+  // volumes keep the scale of path lengths (mm) for the stopping criterion
+  voxels := tangentVoxels(gradient, mask, vz)
+  var mean float64
+  for n, v := range voxels {
+    var l float64
+    for c := 0; c < 3; c++ {
+      t := float64(gradient[v.k][v.j][v.i*3+c] / vz[c])
+      l = l + t*t
+    }
+    voxels[n].w = float32(1/math.Sqrt(l))
+    mean = mean + 1/math.Sqrt(l)
+  }
+  if len(voxels) > 0 {
+    mean = mean / float64(len(voxels))
+  }
+  for n := range voxels {
+    voxels[n].w = float32(float64(voxels[n].w) / mean)
+  }
+
+  iterations, change := solvePathLength(v0, voxels, mask, -1, maskTemp0)
+  if verbose {
+    p(fmt.Sprintf("V0 computed in %d iterations (last change %g)", iterations, change))
+  }
+  iterations, change = solvePathLength(v1, voxels, mask, 1, maskTemp1)
+  if verbose {
+    p(fmt.Sprintf("V1 computed in %d iterations (last change %g)", iterations, change))
+  }
+  _, depth := thicknessAndDepth(v0, v1)
+  return depth
+}
+
+// depth in 0..1 mapped to the boundary temperatures so that the shells of the label writer are
+// computed from the equivolumetric depth
+func depthTemperatures( depth [][][]float32, mask [][][]uint8 ) ( [][][]float32 ) {
+  field := make([][][]float32, len(depth))
+  for k := range depth {
+    field[k] = make([][]float32, len(depth[k]))
+    for j := range depth[k] {
+      field[k][j] = make([]float32, len(depth[k][j]))
+      for i := range depth[k][j] {
+        if mask[k][j][i] == maskSimulate {
+          field[k][j][i] = lowTemperature + (highTemperature-lowTemperature)*depth[k][j][i]
+        }
+      }
+    }
+  }
+  return field
+}
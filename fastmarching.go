@@ -0,0 +1,125 @@
+package main
+
+import (
+  "math"
+  "sort"
+  "container/heap"
+)
+
+// trial voxel of the fast marching front
+type marchingVoxel struct {
+  t float64
+  idx int
+}
+
+// min-heap of trial voxel, voxel are added again when their value improves (older entries are skipped)
+type marchingFront []marchingVoxel
+
+func (h marchingFront) Len() int            { return len(h) }
+func (h marchingFront) Less(a, b int) bool  { return h[a].t < h[b].t }
+func (h marchingFront) Swap(a, b int)       { h[a], h[b] = h[b], h[a] }
+func (h *marchingFront) Push(x interface{}) { *h = append(*h, x.(marchingVoxel)) }
+func (h *marchingFront) Pop() interface{} {
+  old := *h
+  v := old[len(old)-1]
+  *h = old[0:len(old)-1]
+  return v
+}
+
+// Geodesic distance (mm) inside the simulated voxel from the boundary voxel of class seed
+// computed by fast marching (first order upwind solution of |grad T| = 1, Sethian 1996).
+// Voxel that can not be reached have an infinite distance.
+func geodesicDistance( mask [][][]uint8, seed uint8, vz [3]float32 ) ( [][][]float32 ) {
+  var dims [3]int
+  dims[2] = len(mask)
+  dims[1] = len(mask[0])
+  dims[0] = len(mask[0][0])
+  n := dims[0]*dims[1]*dims[2]
+  stride := [3]int{1, dims[0], dims[0]*dims[1]}
+  dist := make([]float64, n)
+  frozen := make([]bool, n)
+  at := func( idx int ) ( uint8 ) {
+    return mask[idx/stride[2]][(idx/stride[1])%dims[1]][idx%dims[0]]
+  }
+  // neighbor of idx along axis in direction dir, -1 outside of the volume
+  neighbor := func( idx int, axis int, dir int ) ( int ) {
+    c := (idx/stride[axis]) % dims[axis]
+    if c+dir < 0 || c+dir >= dims[axis] {
+      return -1
+    }
+    return idx + dir*stride[axis]
+  }
+  front := &marchingFront{}
+  for idx := 0; idx < n; idx++ {
+    dist[idx] = math.Inf(1)
+    if at(idx) == seed {
+      dist[idx] = 0
+      heap.Push(front, marchingVoxel{0, idx})
+    }
+  }
+
+  var h2 [3]float64
+  for c := 0; c < 3; c++ {
+    h2[c] = float64(vz[c])*float64(vz[c])
+  }
+  type axisValue struct {
+    a, h2 float64
+  }
+  values := make([]axisValue, 0, 3)
+  for front.Len() > 0 {
+    v := heap.Pop(front).(marchingVoxel)
+    if frozen[v.idx] || v.t > dist[v.idx] {
+      continue
+    }
+    frozen[v.idx] = true
+    for axis := 0; axis < 3; axis++ {
+      for _, dir := range []int{-1, 1} {
+        nb := neighbor(v.idx, axis, dir)
+        if nb < 0 || frozen[nb] || at(nb) != maskSimulate {
+          continue
+        }
+        // smallest frozen neighbor along each axis
+        values = values[0:0]
+        for c := 0; c < 3; c++ {
+          a := math.Inf(1)
+          for _, d := range []int{-1, 1} {
+            if m := neighbor(nb, c, d); m >= 0 && frozen[m] && dist[m] < a {
+              a = dist[m]
+            }
+          }
+          if !math.IsInf(a, 1) {
+            values = append(values, axisValue{a, h2[c]})
+          }
+        }
+        sort.Slice(values, func( x, y int ) bool { return values[x].a < values[y].a })
+        // solve sum_c (t-a_c)^2/h_c^2 = 1 using the axes with a_c < t
+        var A, B, C, t float64
+        for m, av := range values {
+          A = A + 1/av.h2
+          B = B + av.a/av.h2
+          C = C + av.a*av.a/av.h2
+          t = (B + math.Sqrt(math.Max(0, B*B - A*(C-1)))) / A
+          if m+1 == len(values) || t <= values[m+1].a {
+            break
+          }
+        }
+        if t < dist[nb] {
+          dist[nb] = t
+          heap.Push(front, marchingVoxel{t, nb})
+        }
+      }
+    }
+  }
+
+  out := make([][][]float32, dims[2])
+  for k := range out {
+    out[k] = make([][]float32, dims[1])
+    for j := range out[k] {
+      out[k][j] = make([]float32, dims[0])
+      for i := range out[k][j] {
+        out[k][j][i] = float32(dist[k*stride[2] + j*stride[1] + i])
+      }
+    }
+  }
+  return out
+}
@@ -3,7 +3,10 @@ package main
 import "fmt"
 import "os"
 import "path"
+import "strings"
 import "log"
+import "syscall"
+import "os/signal"
 import "runtime/pprof"
 import "github.com/codegangsta/cli"
 
@@ -24,13 +27,135 @@ func p( t string) {
 // ./heat on aseg.mgz --temp0 50 --temp0 77 --temp0 43 --temp0 38 --temp0 4 --temp0 11 --temp1 42 --temp1 3 --simulate 41 --simulate 2 --simulate 13 --simulate 12 --simulate 29 --simulate 30 --simulate 27 --simulate 10
 // Single hemisphere (FreeSurfer label):
 // ./heat --verbose on aseg.mgz --t0 42 --t1 50 --t1 43 --t1 77 --t1 63 --t1 44 --s 41 --s 51 --s 52 --s 49 --s 62 --s 53 --s 54 --s 58 --iterations "200"
+// or the same using a preset (see presets.go):
+// ./heat --verbose on aseg.mgz --preset rh-wm --iterations "200"
+
+const version = "0.0.1"
+
+// concatenate lists of command line options
+func joinFlags( lists ...[]cli.Flag ) ( []cli.Flag ) {
+  var flags []cli.Flag
+  for _, l := range lists {
+    flags = append(flags, l...)
+  }
+  return flags
+}
+
+// options shared by all commands that solve the heat equation
+func simulationFlags() ( []cli.Flag ) {
+  return joinFlags([]cli.Flag{
+    cli.StringFlag {
+      Name: "preset",
+      Value: "",
+      Usage: "Use the labels of a preset for FreeSurfer's aseg (see 'heat presets'), --t0, --t1 and --s replace them",
+    },
+    cli.StringSliceFlag {
+      Name: "temp0,t0",
+      Value: &cli.StringSlice{},
+      Usage: "Identify segments which have a low temperature (label number or name). Can be specified more than once.",
+    },
+    cli.StringSliceFlag {
+      Name: "temp1,t1",
+      Value: &cli.StringSlice{},
+      Usage: "Segments which has a high temperature",
+    },
+    cli.StringSliceFlag {
+      Name: "simulate,s",
+      Value: &cli.StringSlice{},
+      Usage: "Segments for which the heat equation will be solved",
+    },
+    cli.StringFlag {
+      Name: "lut",
+      Value: "",
+      Usage: "Lookup table (FreeSurferColorLUT format) for label names, default are the aseg labels",
+    },
+  }, maskFlags(), temperatureFlags(), []cli.Flag{
+    cli.Float64Flag {
+      Name: "stepsize",
+      Value: 0.12,
+      Usage: "Simulation step size, should be small enough to not get Inf values",
+    },
+    cli.IntFlag {
+      Name: "iterations",
+      Value: 100,
+      Usage: "Number of iterations performed",
+    },
+    cli.StringFlag {
+      Name: "stencil",
+      Value: "6",
+      Usage: "Laplacian stencil of the simulation and the gradient, 6, 18 or 26 neighbors or 4th order (6, 18, 26 or 4th), 6 keeps the boundary handling of earlier versions, the others mirror neighbors with another label",
+    },
+    cli.StringFlag {
+      Name: "start",
+      Value: "mean",
+      Usage: "Initial temperature of the simulated voxel, mean of the boundary temperatures or from the distances to both boundaries (mean or distance)",
+    },
+    cli.StringFlag {
+      Name: "source",
+      Value: "",
+      Usage: "Source term (temperature per mm^2) as a number or a volume, solves the Poisson equation lap(T) = -source in the simulated voxel",
+    },
+  })
+}
+
+// start values of the simulation given by --start or --init
+func initialState( c *cli.Context, labels [][][]uint8, temp0 []int, temp1 []int, sim []int, head header, verbose bool ) ( simulationState, error ) {
+  var state simulationState
+  if c.String("init") != "" {
+    initial, err := readInitialField(c.String("init"), head, verbose)
+    if err != nil {
+      return state, err
+    }
+    state.initial = initial
+    return state, nil
+  }
+  switch c.String("start") {
+  case "mean":
+  case "distance":
+    if verbose {
+      p("initial temperatures from the distances to the temp0 and temp1 boundaries")
+    }
+    state.initial = distanceInitialField(classifyVoxels(labels, temp0, temp1, sim), head)
+  default:
+    return state, fmt.Errorf("unknown start %s, use mean or distance", c.String("start"))
+  }
+  return state, nil
+}
+
+// temperatures of the two boundaries
+func temperatureFlags() ( []cli.Flag ) {
+  return []cli.Flag{
+    cli.Float64Flag {
+      Name: "temp0-value",
+      Value: float64(lowTemperature),
+      Usage: "Temperature of the --temp0 segments",
+    },
+    cli.Float64Flag {
+      Name: "temp1-value",
+      Value: float64(highTemperature),
+      Usage: "Temperature of the --temp1 segments, has to be larger than the temp0 temperature",
+    },
+  }
+}
+
+// use the boundary temperatures given by --temp0-value and --temp1-value
+func setTemperatures( c *cli.Context ) ( error ) {
+  low  := float32(c.Float64("temp0-value"))
+  high := float32(c.Float64("temp1-value"))
+  if !(low < high) {
+    return fmt.Errorf("the temp0 temperature (%g) has to be lower than the temp1 temperature (%g)", low, high)
+  }
+  lowTemperature  = low
+  highTemperature = high
+  return nil
+}
 
 func main() {
 
      app := cli.NewApp()
      app.Name    = "heat"
      app.Usage   = "Solving the heat equation on a 3D grid"
-     app.Version = "0.0.1"
+     app.Version = version
      app.Author  = "Hauke Bartsch"
      app.Email   = "HaukeBartsch@gmail.com"
      app.Flags = []cli.Flag {
@@ -53,40 +178,18 @@ func main() {
          Description: "Uses a label field (mgz-format) to solve the heat equation given a set of labels.\n\n" +
                       "   The --temp1 and --temp0 switches will fix the temperatures for labels in\n" +
                       "   the volume to low and high. The --simulate switch identifies label for\n" +
-                      "   which the heat distribution will be simulated.\n\n" +
+                      "   which the heat distribution will be simulated. Labels are numbers or names\n" +
+                      "   from FreeSurfer's lookup table (e.g. Left-Lateral-Ventricle, see --lut).\n\n" +
                       "   Most likely you will want to specify the --label <N> option to generate\n" +
                       "   individual label based on the calculated distances. The segments are created\n" +
                       "   so that each region has approximately the same number of voxel. This operation\n" +
                       "   can only succeed if the simulation resulted in a suffient number of voxel\n" +
                       "   for each range of temperature values.\n\n" +
+                      "   All settings can be read from a yaml or json file with --config, options\n" +
+                      "   given on the command line take precedence over the file.\n\n" +
                       "   Example:\n" + 
                       "     heat --verbose on aseg.mgz --t0 1 --t0 2 --t1 4 --s 3 -s 5 --label 3" ,
-         Flags: []cli.Flag{
-           cli.IntSliceFlag {
-             Name: "temp0,t0",
-             Value: &cli.IntSlice{},
-             Usage: "Identify segments which have a low temperature. Can be specified more than once.",
-           },
-           cli.IntSliceFlag {
-             Name: "temp1,t1",
-             Value: &cli.IntSlice{},
-             Usage: "Segments which has a high temperature",
-           },
-           cli.IntSliceFlag {
-             Name: "simulate,s",
-             Value: &cli.IntSlice{},
-             Usage: "Segments for which the heat equation will be solved",
-           },
-           cli.Float64Flag {
-             Name: "stepsize",
-             Value: 0.12,
-             Usage: "Simulation step size, should be small enough to not get Inf values",
-           },
-           cli.IntFlag {
-             Name: "iterations",
-             Value: 100,
-             Usage: "Number of iterations performed",
-           },
+         Flags: joinFlags(simulationFlags(), []cli.Flag{
            cli.IntFlag {
              Name: "label",
              Value: 3,
@@ -100,10 +203,97 @@ func main() {
              Name: "gradient",
              Usage: "Create the gradient of the temperature field (nframes=3)",
            },
-         },
+           cli.BoolFlag {
+             Name: "direction",
+             Usage: "Create the unit length direction field of the gradient in mm (nframes=3)",
+           },
+           cli.BoolFlag {
+             Name: "magnitude",
+             Usage: "Create the magnitude of the gradient (temperature per mm)",
+           },
+           cli.StringFlag {
+             Name: "method",
+             Value: "heat",
+             Usage: "Depth between the boundaries from the heat equation, equivolumetric depth along its streamlines (one-pass approximation), Euclidean distances or geodesic distances inside the simulated segments (heat, equivolume, euclidean or geodesic)",
+           },
+           cli.StringFlag {
+             Name: "scheme",
+             Value: "central",
+             Usage: "Differencing scheme used for the gradient (central, sobel or upwind)",
+           },
+           cli.BoolFlag {
+             Name: "thickness",
+             Usage: "Create thickness, L0 and L1 distances (mm) and normalized depth along the gradient",
+           },
+           cli.StringFlag {
+             Name: "config",
+             Value: "",
+             Usage: "Read input, labels, temperatures, solver settings and outputs from a yaml or json file (options given here take precedence)",
+           },
+           cli.StringFlag {
+             Name: "init",
+             Value: "",
+             Usage: "Start the simulation from a previous temperature field (resampled if the voxel grid differs)",
+           },
+           cli.IntFlag {
+             Name: "upsample",
+             Value: 1,
+             Usage: "Simulate on a N times finer grid (nearest neighbor labels), outputs are written at both resolutions",
+           },
+           cli.StringFlag {
+             Name: "isolated",
+             Value: "keep",
+             Usage: "Simulated components that touch neither boundary are kept, dropped from the simulation or dropped and flagged in the label output (keep, drop or flag)",
+           },
+           cli.BoolFlag {
+             Name: "no-crop",
+             Usage: "Simulate the full volume instead of the bounding box of the labels",
+           },
+           cli.IntFlag {
+             Name: "crop-margin",
+             Value: 2,
+             Usage: "Voxel added on each side of the bounding box of the labels",
+           },
+           cli.StringFlag {
+             Name: "stats",
+             Value: "",
+             Usage: "Write iterations, residual and runtime of the simulation to this json file",
+           },
+         }, preprocessFlags(), checkpointFlags(), outputLocationFlags(), outputFileFlags(), bidsFlags()),
          Action: func(c *cli.Context) {
-           if len(c.Args()) < 1 {
+           input, err := applyConfig(c)
+           if len(c.Args()) > 0 {
+             input = c.Args()[0]
+           }
+           if err == nil {
+             err = applyPreset(c)
+           }
+           if err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+           } else if input == "" {
              fmt.Printf("  Error: Specify an input label field as mgh file\n\n")
+           } else if !contains(gradientSchemes, c.String("scheme")) {
+             fmt.Printf("  Error: Unknown gradient scheme %s, use one of %v\n\n", c.String("scheme"), gradientSchemes)
+           } else if !contains(depthMethods, c.String("method")) {
+             fmt.Printf("  Error: Unknown method %s, use one of %v\n\n", c.String("method"), depthMethods)
+           } else if !simulatedMethod(c.String("method")) && (c.String("init") != "" || c.String("start") != "mean" || c.String("source") != "" || c.Int("checkpoint-every") > 0 || c.Bool("resume")) {
+             fmt.Printf("  Error: --init, --start, --source, --checkpoint-every and --resume can only be used with --method heat or equivolume\n\n")
+           } else if c.Int("upsample") < 1 {
+             fmt.Printf("  Error: --upsample has to be at least 1\n\n")
+           } else if !contains(isolatedActions, c.String("isolated")) {
+             fmt.Printf("  Error: Unknown --isolated %s, use one of %v\n\n", c.String("isolated"), isolatedActions)
+           } else if maxShells := int(isolatedShell); c.Int("label") < 2 || c.Int("label") > maxShells || (c.Int("label") == maxShells && c.String("isolated") == "flag") {
+             fmt.Printf("  Error: --label has to be between 2 and %d (%d with --isolated flag)\n\n", maxShells, maxShells-1)
+           } else if c.Int("crop-margin") < 1 {
+             fmt.Printf("  Error: --crop-margin has to be at least 1\n\n")
+           } else if c.String("scheme") != "central" && c.String("stencil") != "6" {
+             fmt.Printf("  Error: --scheme %s can only be used with --stencil 6\n\n", c.String("scheme"))
+           } else if err := setTemperatures(c); err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+           } else if st, err := newStencil(c.String("stencil")); err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+           } else if simulatedMethod(c.String("method")) && float32(c.Float64("stepsize")) > st.maxStep {
+             fmt.Printf("  Error: --stepsize %g is not stable with --stencil %s, use at most %.4g\n\n", c.Float64("stepsize"), st.name, st.maxStep)
            } else {
              verbose     := c.GlobalBool("verbose")
              if (verbose) {
@@ -122,34 +312,583 @@ func main() {
              }
 
 
-             labels, header := readMGH( c.Args()[0], verbose )
+             temp0, temp1, sim, err := resolveLabels(c, verbose)
+             if err != nil {
+               fmt.Printf("  Error: %s\n\n", err)
+               return
+             }
+             edits, err := parseLabelEdits(c)
+             if err != nil {
+               fmt.Printf("  Error: %s\n\n", err)
+               return
+             }
+
+             // requested outputs, make sure we can write them before we start
+             out, err := newOutputNames(c, input)
+             if err != nil {
+               fmt.Printf("  Error: %s\n\n", err)
+               return
+             }
+             outputs := []string{"temperature"}
+             for _, o := range []string{"label", "gradient", "direction", "magnitude"} {
+               if c.IsSet(o) {
+                 outputs = append(outputs, o)
+               }
+             }
+             if c.IsSet("thickness") {
+               outputs = append(outputs, "thickness", "L0", "L1", "depth")
+             }
+             if c.String("method") == "equivolume" {
+               outputs = append(outputs, "equivolume")
+             }
+             if err := out.prepare(outputs); err != nil {
+               fmt.Printf("  Error: %s\n\n", err)
+               return
+             }
+             // sidecars, look-up tables and statistics are not overwritten either
+             var files []string
+             if c.Int("upsample") > 1 {
+               for _, o := range outputs {
+                 fn := upsampledName(out.name(o), c.Int("upsample"))
+                 files = append(files, fn, sidecarName(fn))
+               }
+             }
+             if out.bids != nil && c.IsSet("label") {
+               files = append(files, shellsTSVName(out.name("label")))
+               if c.Int("upsample") > 1 {
+                 files = append(files, shellsTSVName(upsampledName(out.name("label"), c.Int("upsample"))))
+               }
+             }
+             if c.String("stats") != "" {
+               files = append(files, c.String("stats"))
+             }
+             for _, fn := range files {
+               if err := out.prepareFile(fn); err != nil {
+                 fmt.Printf("  Error: %s\n\n", err)
+                 return
+               }
+             }
+             checkpointFile := ""
+             if c.Int("checkpoint-every") > 0 || c.Bool("resume") {
+               checkpointFile = c.String("checkpoint")
+               if checkpointFile == "" {
+                 checkpointFile = out.name("checkpoint")
+               }
+               if err := checkCheckpointName(checkpointFile); err != nil {
+                 fmt.Printf("  Error: %s\n\n", err)
+                 return
+               }
+             }
+
+             prov := newProvenance(input)
+             labels, header := readMGH( input, verbose )
+             prov.head = header
+             preprocessing := edits.apply(labels, verbose, temp0, temp1, sim)
+             temp0, temp1, sim, masks, err := applyMasks(c, labels, header, temp0, temp1, sim, verbose)
+             if err != nil {
+               fmt.Printf("  Error: %s\n\n", err)
+               return
+             }
+             source, err := parseSource(c.String("source"), header, verbose)
+             if err != nil {
+               fmt.Printf("  Error: %s\n\n", err)
+               return
+             }
+             // simulate on a finer grid, all outputs are also written downsampled to the input grid
+             res := newResolutions(header, c.Int("upsample"), verbose)
+             if !c.Bool("no-crop") {
+               // only the bounding box of the labels is simulated
+               labels, header = res.crop(labels, c.Int("crop-margin"), temp0, temp1, sim)
+             }
+             if res.n > 1 {
+               labels = upsampleLabels(labels, res.n)
+               header = upsampleHeader(header, res.n)
+               if verbose {
+                 p(fmt.Sprintf("upsample the label field by %d to %dx%dx%d voxel", res.n, header.width, header.height, header.depth))
+               }
+             }
+             if source != nil {
+               source.grid(labels, res.offset, res.n, header)
+             }
              
-             temp0 := c.IntSlice("temp0")
-             temp1 := c.IntSlice("temp1")
-             sim   := c.IntSlice("simulate")
              omega := c.Float64("stepsize")
              iterations := c.Int("iterations")
              
-             field := simulate(labels, temp0, temp1, sim, float32(omega), iterations, c.Bool("showAllTemps"), verbose)
+             // simulated components that touch neither boundary keep their start values
+             mask := classifyVoxels(labels, temp0, temp1, sim)
+             comp, components := simulatedComponents(mask, len(st.offsets))
+             componentSummary := reportComponents(components, c.String("isolated"), verbose)
+             var isolated [][][]bool
+             if c.String("isolated") != "keep" {
+               isolated = excludeIsolated(mask, comp, components)
+             }
+
+             var field [][][]float32
+             var stats solverStats
+             var cp *checkpointer
+             if !simulatedMethod(c.String("method")) {
+               field, mask, stats = distanceMethod(c.String("method"), mask, header, c.Bool("showAllTemps"), verbose)
+             } else {
+               state, err := initialState(c, labels, temp0, temp1, sim, header, verbose)
+               if err != nil {
+                 fmt.Printf("  Error: %s\n\n", err)
+                 return
+               }
+               state.mask = mask
+               state.source = source
+               if checkpointFile != "" {
+                 // continue from the last checkpoint and save new ones, also if the job gets killed
+                 cp = newCheckpointer(checkpointFile, header, prov, temp0, temp1, sim, omega, st.name, verbose)
+                 // edits of the label field and masks change the simulated region
+                 cp.info.Preprocessing = preprocessing
+                 cp.info.Masks = maskFiles(masks)
+                 if source != nil {
+                   cp.info.Source = source.description
+                 }
+                 if c.Bool("resume") {
+                   initial, iteration, err := cp.load()
+                   if err != nil {
+                     fmt.Printf("  Error: %s\n\n", err)
+                     return
+                   }
+                   if initial != nil {
+                     if verbose {
+                       p(fmt.Sprintf("resume simulation at iteration %d from %s", iteration, checkpointFile))
+                     }
+                     state.initial = initial
+                     state.first = iteration
+                   }
+                 }
+                 state.checkpointEvery = c.Int("checkpoint-every")
+                 state.checkpoint = cp.save
+                 state.stop = make(chan os.Signal, 1)
+                 signal.Notify(state.stop, syscall.SIGTERM, os.Interrupt)
+               }
+
+               field, mask, stats = simulate(labels, temp0, temp1, sim, float32(omega), iterations, st, c.Bool("showAllTemps"), verbose, state)
+               if stats.interrupted {
+                 fmt.Printf("  Error: simulation stopped at iteration %d, continue with --resume (checkpoint %s)\n\n", stats.iterations, checkpointFile)
+                 os.Exit(-1)
+               }
+             }
  
-             d, f  := path.Split(c.Args()[0])
+             var gradient [][][]float32
+             if c.IsSet("gradient") || c.IsSet("direction") || c.IsSet("magnitude") || c.IsSet("thickness") || c.String("method") == "equivolume" {
+               gradient = computeGradientField(field, mask, c.String("scheme"), st)
+             }
+
+             // shells follow the temperature or, for the equivolume method, the equivolumetric depth
+             shellField := field
+             if c.String("method") == "equivolume" {
+               depth := equivolumeDepth(gradient, mask, header, verbose)
+               res.saveMGH(depth, out.name("equivolume"))
+               shellField = depthTemperatures(depth, mask)
+             }
+
              if c.IsSet("label") {
                // save a distance field version of the data (from low to high temperature in uniform intervals
-               label := computeDistanceField(field, labels, sim, c.Int("label"), verbose)
-               fn    := path.Join(d, f[0:len(f)-len(path.Ext(f))] + "_label.mgz")
-               saveMGHuint8(label, fn, header, verbose)           
+               label := computeDistanceField(shellField, mask, c.Int("label"), verbose)
+               if c.String("isolated") == "flag" {
+                 flagIsolated(label, isolated)
+               }
+               res.saveMGHuint8(label, out.name("label"))           
              }
              
              if c.IsSet("gradient") {
                // save the gradient of the temperature field
-               gradient := computeGradientField(field, labels, sim)
-               fn    := path.Join(d, f[0:len(f)-len(path.Ext(f))] + "_gradient.mgz")
-               saveMGHgradient(gradient, fn, header, verbose)
+               res.saveMGHgradient(gradient, out.name("gradient"), false)
+             }
+
+             if c.IsSet("direction") || c.IsSet("magnitude") {
+               direction, magnitude := normalizeGradient(gradient, header)
+               if c.IsSet("direction") {
+                 res.saveMGHgradient(direction, out.name("direction"), true)
+               }
+               if c.IsSet("magnitude") {
+                 res.saveMGH(magnitude, out.name("magnitude"))
+               }
+             }
+
+             if c.IsSet("thickness") {
+               // save path lengths along the normalized gradient from both boundaries (Yezzi-Prince)
+               l0, l1 := computeThickness(gradient, mask, header, verbose)
+               thickness, depth := thicknessAndDepth(l0, l1)
+               res.saveMGH(thickness, out.name("thickness"))
+               res.saveMGH(l0, out.name("L0"))
+               res.saveMGH(l1, out.name("L1"))
+               res.saveMGH(depth, out.name("depth"))
              }
              
-             fn    := path.Join(d, f[0:len(f)-len(path.Ext(f))] + "_temperatur.mgz")
-             saveMGH(field, fn, header, verbose)
+             res.saveMGH(field, out.name("temperature"))
+
+             // describe each output and the settings used to create it
+             for _, o := range outputs {
+               fields := prov.fields()
+               fields["Description"] = outputDescriptions[o]
+               fields["Labels"] = map[string][]int{"temp0": temp0, "temp1": temp1, "simulate": sim}
+               fields["Temperatures"] = map[string]float32{"temp0": lowTemperature, "temp1": highTemperature}
+               solver := solverFields(c.String("method"), omega, iterations, stats)
+               solver["GradientScheme"] = c.String("scheme")
+               solver["Stencil"] = st.name
+               if c.String("init") != "" {
+                 solver["InitialField"] = c.String("init")
+               }
+               if source != nil {
+                 solver["Source"] = source.description
+               }
+               fields["Solver"] = solver
+               if o == "label" {
+                 fields["NumberOfShells"] = c.Int("label")
+                 if c.String("isolated") == "flag" {
+                   fields["IsolatedShell"] = isolatedShell
+                 }
+               }
+               fields["SimulatedComponents"] = componentSummary
+               if len(preprocessing) > 0 {
+                 fields["Preprocessing"] = preprocessing
+               }
+               if len(masks) > 0 {
+                 fields["Masks"] = masks
+               }
+               if c.String("config") != "" {
+                 fields["Config"] = c.String("config")
+               }
+               if out.bids != nil {
+                 fields["Sources"] = []string{out.bids.source}
+               }
+               if res.n > 1 {
+                 fields["Upsample"] = res.n
+               }
+               writeSidecar(out.name(o), fields, verbose)
+               if res.n > 1 {
+                 // the output at the grid of the simulation
+                 fields["Geometry"] = geometryFields(res.fine)
+                 writeSidecar(upsampledName(out.name(o), res.n), fields, verbose)
+               }
+             }
+             if out.bids != nil {
+               writeDatasetDescription(out.bids.root, version, verbose)
+               if c.IsSet("label") {
+                 for _, fn := range res.names(out.name("label")) {
+                   writeShellsTSV(fn, c.Int("label"), c.String("isolated") == "flag", verbose)
+                 }
+               }
+             }
+             if c.String("stats") != "" {
+               saveStats(stats, input, c.String("stats"), verbose)
+             }
+             if cp != nil {
+               cp.remove()
+             }
+           }
+         },
+       },
+       {
+         Name: "trace",
+         ShortName: "t",
+         Usage: "Trace streamlines through the gradient of the temperature field.",
+         Description: "Uses a label field (mgz-format) to solve the heat equation given a set of labels\n" +
+                      "   (see the 'on' command) and integrates streamlines (4th order Runge-Kutta with\n" +
+                      "   trilinear interpolation) from the --temp0 boundary along the gradient of the\n" +
+                      "   temperature field to the --temp1 boundary. Use --temperature to trace through\n" +
+                      "   an existing temperature field instead of solving the heat equation again.\n\n" +
+                      "   Streamlines are saved in TrackVis (.trk) or VTK polydata (.vtk) format, the\n" +
+                      "   length of each streamline (mm) is stored with it.\n\n" +
+                      "   Example:\n" +
+                      "     heat trace aseg.mgz --t0 42 --t1 50 --t1 43 --s 41 --output streamlines.trk",
+         Flags: joinFlags(simulationFlags(), []cli.Flag{
+           cli.StringFlag {
+             Name: "temperature",
+             Value: "",
+             Usage: "Temperature field (_temperatur.mgz) used instead of solving the heat equation",
+           },
+           cli.StringFlag {
+             Name: "output,o",
+             Value: "",
+             Usage: "Output file (.trk or .vtk), default is <input>_streamlines.trk",
+           },
+           cli.IntFlag {
+             Name: "seeds",
+             Value: 1,
+             Usage: "Number of streamlines started in each voxel at the temp0 boundary",
+           },
+           cli.Float64Flag {
+             Name: "step",
+             Value: 0.5,
+             Usage: "Integration step size in mm",
+           },
+           cli.Float64Flag {
+             Name: "maxlength",
+             Value: 200,
+             Usage: "Maximum length of a streamline in mm",
+           },
+         }, preprocessFlags(), outputLocationFlags()),
+         Action: func(c *cli.Context) {
+           if len(c.Args()) < 1 {
+             fmt.Printf("  Error: Specify an input label field as mgh file\n\n")
+             return
+           }
+           verbose := c.GlobalBool("verbose")
+           out, err := newOutputNames(c, c.Args()[0])
+           if err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+             return
+           }
+           fn := c.String("output")
+           if fn == "" {
+             fn = out.name("streamlines")
+           }
+           if path.Ext(fn) != ".trk" && path.Ext(fn) != ".vtk" {
+             fmt.Printf("  Error: output file has to end in .trk or .vtk\n\n")
+             return
+           }
+           if c.Float64("step") <= 0 || c.Int("seeds") < 1 {
+             fmt.Printf("  Error: step has to be positive and seeds at least 1\n\n")
+             return
+           }
+           if err := applyPreset(c); err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+             return
+           }
+           if err := setTemperatures(c); err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+             return
+           }
+           st, err := newStencil(c.String("stencil"))
+           if err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+             return
+           }
+           if c.String("temperature") == "" && float32(c.Float64("stepsize")) > st.maxStep {
+             fmt.Printf("  Error: --stepsize %g is not stable with --stencil %s, use at most %.4g\n\n", c.Float64("stepsize"), st.name, st.maxStep)
+             return
+           }
+           for _, f := range []string{fn, sidecarName(fn)} {
+             if err := out.prepareFile(f); err != nil {
+               fmt.Printf("  Error: %s\n\n", err)
+               return
+             }
+           }
+
+           temp0, temp1, sim, err := resolveLabels(c, verbose)
+           if err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+             return
+           }
+           edits, err := parseLabelEdits(c)
+           if err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+             return
+           }
+           labels, head := readMGH( c.Args()[0], verbose )
+           preprocessing := edits.apply(labels, verbose, temp0, temp1, sim)
+           temp0, temp1, sim, masks, err := applyMasks(c, labels, head, temp0, temp1, sim, verbose)
+           if err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+             return
+           }
+           source, err := parseSource(c.String("source"), head, verbose)
+           if err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+             return
+           }
+
+           prov := newProvenance(c.Args()[0])
+           prov.head = head
+           var field [][][]float32
+           var mask [][][]uint8
+           var stats solverStats
+           if c.String("temperature") != "" {
+             var theader header
+             field, theader = readMGHfloat( c.String("temperature"), verbose )
+             if !sameDimensions(head, theader) {
+               fmt.Printf("  Error: temperature field and label field have different dimensions\n\n")
+               return
+             }
+             mask = classifyVoxels(labels, temp0, temp1, sim)
+           } else {
+             state, err := initialState(c, labels, temp0, temp1, sim, head, verbose)
+             if err != nil {
+               fmt.Printf("  Error: %s\n\n", err)
+               return
+             }
+             state.source = source
+             field, mask, stats = simulate(labels, temp0, temp1, sim, float32(c.Float64("stepsize")), c.Int("iterations"), st, false, verbose, state)
+           }
+           gradient := computeGradientField(field, mask, "central", st)
+           lines := traceStreamlines(gradient, mask, head, c.Int("seeds"), c.Float64("step"), c.Float64("maxlength"), verbose)
+           if path.Ext(fn) == ".vtk" {
+             saveVTK(lines, fn, head, verbose)
+           } else {
+             saveTRK(lines, fn, head, verbose)
+           }
+
+           fields := prov.fields()
+           fields["Description"] = "Streamlines along the gradient of the temperature field from the temp0 to the temp1 boundary"
+           fields["Labels"] = map[string][]int{"temp0": temp0, "temp1": temp1, "simulate": sim}
+           fields["Temperatures"] = map[string]float32{"temp0": lowTemperature, "temp1": highTemperature}
+           if c.String("temperature") != "" {
+             fields["TemperatureField"] = map[string]string{"Path": c.String("temperature"), "SHA256": fileSHA256(c.String("temperature"))}
+           } else {
+             solver := solverFields("heat", c.Float64("stepsize"), c.Int("iterations"), stats)
+             if source != nil {
+               solver["Source"] = source.description
+             }
+             fields["Solver"] = solver
+           }
+           fields["Stencil"] = st.name
+           if len(preprocessing) > 0 {
+             fields["Preprocessing"] = preprocessing
+           }
+           if len(masks) > 0 {
+             fields["Masks"] = masks
+           }
+           fields["Tracking"] = map[string]interface{}{"Seeds": c.Int("seeds"), "Step": c.Float64("step"), "MaxLength": c.Float64("maxlength"), "Streamlines": len(lines)}
+           writeSidecar(fn, fields, verbose)
+         },
+       },
+       {
+         Name: "profile",
+         ShortName: "p",
+         Usage: "Report depth and shell membership for each connected lesion in a mask.",
+         Description: "Uses a temperature field (_temperatur.mgz) or a shell label field (_label.mgz)\n" +
+                      "   created by the 'on' command together with a lesion mask in the same space.\n\n" +
+                      "   Each connected component of non-zero voxel in the mask is reported with its\n" +
+                      "   voxel count, centroid (voxel coordinates), the mean/min/max normalized depth\n" +
+                      "   (0 at the --temp0 boundary, 1 at the --temp1 boundary) and the number of voxel\n" +
+                      "   in each shell. Use --shells to add the shell membership to a temperature field.\n" +
+                      "   Use --temp0-value and --temp1-value if the field was created with other temperatures.\n\n" +
+                      "   Example:\n" +
+                      "     heat profile aseg_temperatur.mgz lesions.mgz --shells aseg_label.mgz --output lesions.csv",
+         Flags: joinFlags([]cli.Flag{
+           cli.StringFlag {
+             Name: "shells",
+             Value: "",
+             Usage: "Shell label field (_label.mgz) used for the shell membership",
+           },
+           cli.StringFlag {
+             Name: "output,o",
+             Value: "",
+             Usage: "Write the table to this csv file instead of stdout",
+           },
+           cli.IntFlag {
+             Name: "connectivity",
+             Value: 26,
+             Usage: "Neighborhood used to separate lesions (6, 18 or 26)",
+           },
+         }, temperatureFlags()),
+         Action: func(c *cli.Context) {
+           if len(c.Args()) < 2 {
+             fmt.Printf("  Error: Specify a temperature (or shell) field and a lesion mask as mgh files\n\n")
+             return
+           }
+           verbose := c.GlobalBool("verbose")
+           connectivity := c.Int("connectivity")
+           if connectivity != 6 && connectivity != 18 && connectivity != 26 {
+             fmt.Printf("  Error: connectivity has to be 6, 18 or 26\n\n")
+             return
+           }
+           if err := setTemperatures(c); err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+             return
+           }
+
+           field, fheader := readMGHfloat( c.Args()[0], verbose )
+           lesions, lheader := readMGHfloat( c.Args()[1], verbose )
+           if !sameDimensions(fheader, lheader) {
+             fmt.Printf("  Error: lesion mask and field have different dimensions\n\n")
+             return
+           }
+           var shells [][][]float32
+           if c.String("shells") != "" {
+             var sheader header
+             shells, sheader = readMGHfloat( c.String("shells"), verbose )
+             if !sameDimensions(fheader, sheader) {
+               fmt.Printf("  Error: shell field and field have different dimensions\n\n")
+               return
+             }
+           }
+           isTemperature := fheader.t == 3
+           profiles, numShells, err := profileLesions(field, isTemperature, shells, lesions, connectivity, verbose)
+           if err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+             return
+           }
+           saveProfileCSV(profiles, numShells, c.String("output"), verbose)
+         },
+       },
+       {
+         Name: "presets",
+         Usage: "List the label presets for FreeSurfer's aseg.mgz.",
+         Description: "Shows the --temp0, --temp1 and --simulate labels of all presets or of the\n" +
+                      "   presets given as arguments. Use a preset with --preset <name>.\n\n" +
+                      "   Example:\n" +
+                      "     heat presets lh-wm\n" +
+                      "     heat on aseg.mgz --preset lh-wm --label 3",
+         Action: func(c *cli.Context) {
+           if err := showPresets(c.Args()); err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+           }
+         },
+       },
+       {
+         Name: "batch",
+         ShortName: "b",
+         Usage: "Run the 'on' command for many subjects.",
+         Description: "Runs 'heat on' for each input file with the same options. Inputs are file names or\n" +
+                      "   glob patterns (quote them to prevent the shell from expanding them) and/or a\n" +
+                      "   --list file with one input per line. All arguments after '--' are passed to\n" +
+                      "   'on', the text {subject} in these options is replaced by the subject name\n" +
+                      "   (sub-<label> folder, FreeSurfer subject folder or the folder of the input).\n\n" +
+                      "   At most --jobs subjects are processed at the same time. Failed subjects do not\n" +
+                      "   stop the batch, the status, runtime, iterations and final residual of the\n" +
+                      "   simulation of each subject are written to the --summary table.\n\n" +
+                      "   Example:\n" +
+                      "     heat batch --jobs 4 \"$SUBJECTS_DIR/*/mri/aseg.mgz\" -- --t0 42 --t1 50 --s 41 --label 3",
+         Flags: []cli.Flag{
+           cli.IntFlag {
+             Name: "jobs,j",
+             Value: 2,
+             Usage: "Number of subjects processed in parallel",
+           },
+           cli.StringFlag {
+             Name: "list",
+             Value: "",
+             Usage: "Text file with one input file (or glob pattern) per line",
+           },
+           cli.StringFlag {
+             Name: "summary",
+             Value: "heat_batch.csv",
+             Usage: "Summary table (csv) with one line per subject",
+           },
+         },
+         Action: func(c *cli.Context) {
+           verbose := c.GlobalBool("verbose")
+           inputs, options, err := batchArguments(c.Args(), c.String("list"))
+           if err != nil {
+             fmt.Printf("  Error: %s\n\n", err)
+             return
+           }
+           if len(inputs) < 1 {
+             fmt.Printf("  Error: Specify input label fields or a --list file\n\n")
+             return
+           }
+           if c.Int("jobs") < 1 {
+             fmt.Printf("  Error: jobs has to be at least 1\n\n")
+             return
+           }
+           if verbose {
+             p(fmt.Sprintf("processing %d subjects with %d jobs, options: %s", len(inputs), c.Int("jobs"), strings.Join(options, " ")))
+           }
+           results := runBatch(inputs, options, c.Int("jobs"), verbose)
+           saveBatchSummary(results, c.String("summary"), verbose)
+           failed := 0
+           for _, r := range results {
+             if !r.ok {
+               failed = failed + 1
+             }
            }
+           p(fmt.Sprintf("%d of %d subjects succeeded, %d failed (see %s)", len(results)-failed, len(results), failed, c.String("summary")))
          },
        },
      }
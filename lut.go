@@ -0,0 +1,206 @@
+package main
+
+import (
+  "fmt"
+  "bufio"
+  "strconv"
+  "strings"
+  "io/ioutil"
+  "encoding/json"
+  "github.com/codegangsta/cli"
+)
+
+// The labels of FreeSurfer's aseg.mgz from FreeSurferColorLUT.txt (index, name, r, g, b, a),
+// use --lut for other segmentations.
+const asegLUT = `
+0   Unknown                         0   0   0   0
+1   Left-Cerebral-Exterior          70  130 180 0
+2   Left-Cerebral-White-Matter      245 245 245 0
+3   Left-Cerebral-Cortex            205 62  78  0
+4   Left-Lateral-Ventricle          120 18  134 0
+5   Left-Inf-Lat-Vent               196 58  250 0
+6   Left-Cerebellum-Exterior        0   148 0   0
+7   Left-Cerebellum-White-Matter    220 248 164 0
+8   Left-Cerebellum-Cortex          230 148 34  0
+9   Left-Thalamus-unused            0   118 14  0
+10  Left-Thalamus                   0   118 14  0
+11  Left-Caudate                    122 186 220 0
+12  Left-Putamen                    236 13  176 0
+13  Left-Pallidum                   12  48  255 0
+14  3rd-Ventricle                   204 182 142 0
+15  4th-Ventricle                   42  204 164 0
+16  Brain-Stem                      119 159 176 0
+17  Left-Hippocampus                220 216 20  0
+18  Left-Amygdala                   103 255 255 0
+19  Left-Insula                     80  196 98  0
+20  Left-Operculum                  60  58  210 0
+24  CSF                             60  60  60  0
+25  Left-Lesion                     255 165 0   0
+26  Left-Accumbens-area             255 165 0   0
+27  Left-Substancia-Nigra           0   255 127 0
+28  Left-VentralDC                  165 42  42  0
+29  Left-undetermined               135 206 235 0
+30  Left-vessel                     160 32  240 0
+31  Left-choroid-plexus             0   200 200 0
+40  Right-Cerebral-Exterior         70  130 180 0
+41  Right-Cerebral-White-Matter     245 245 245 0
+42  Right-Cerebral-Cortex           205 62  78  0
+43  Right-Lateral-Ventricle         120 18  134 0
+44  Right-Inf-Lat-Vent              196 58  250 0
+45  Right-Cerebellum-Exterior       0   148 0   0
+46  Right-Cerebellum-White-Matter   220 248 164 0
+47  Right-Cerebellum-Cortex         230 148 34  0
+48  Right-Thalamus-unused           0   118 14  0
+49  Right-Thalamus                  0   118 14  0
+50  Right-Caudate                   122 186 220 0
+51  Right-Putamen                   236 13  176 0
+52  Right-Pallidum                  13  48  255 0
+53  Right-Hippocampus               220 216 20  0
+54  Right-Amygdala                  103 255 255 0
+55  Right-Insula                    80  196 98  0
+56  Right-Operculum                 60  58  210 0
+57  Right-Lesion                    255 165 0   0
+58  Right-Accumbens-area            255 165 0   0
+59  Right-Substancia-Nigra          0   255 127 0
+60  Right-VentralDC                 165 42  42  0
+61  Right-undetermined              135 206 235 0
+62  Right-vessel                    160 32  240 0
+63  Right-choroid-plexus            0   200 221 0
+72  5th-Ventricle                   120 190 150 0
+77  WM-hypointensities              200 70  255 0
+78  Left-WM-hypointensities         255 148 10  0
+79  Right-WM-hypointensities        255 148 10  0
+80  non-WM-hypointensities          164 108 226 0
+81  Left-non-WM-hypointensities     164 108 226 0
+82  Right-non-WM-hypointensities    164 108 226 0
+85  Optic-Chiasm                    234 169 30  0
+251 CC_Posterior                    0   0   64  0
+252 CC_Mid_Posterior                0   0   112 0
+253 CC_Central                      0   0   160 0
+254 CC_Mid_Anterior                 0   0   208 0
+255 CC_Anterior                     0   0   255 0
+`
+
+// names used by older FreeSurfer versions
+var lutAliases = map[string]string{
+  "left-thalamus-proper":  "left-thalamus",
+  "right-thalamus-proper": "right-thalamus",
+}
+
+// label names of a segmentation
+type lookupTable struct {
+  names map[int]string
+  index map[string]int // lower case name to label
+}
+
+// parse a lookup table in FreeSurferColorLUT format, lines are 'index name r g b a', '#' starts a comment
+func parseLUT( text string ) ( lookupTable, error ) {
+  lut := lookupTable{names: map[int]string{}, index: map[string]int{}}
+  sc := bufio.NewScanner(strings.NewReader(text))
+  line := 0
+  for sc.Scan() {
+    line = line + 1
+    l := sc.Text()
+    if n := strings.Index(l, "#"); n >= 0 {
+      l = l[0:n]
+    }
+    fields := strings.Fields(l)
+    if len(fields) == 0 {
+      continue
+    }
+    v, err := strconv.Atoi(fields[0])
+    if err != nil || len(fields) < 2 {
+      return lut, fmt.Errorf("line %d is not 'index name r g b a'", line)
+    }
+    lut.names[v] = fields[1]
+    lut.index[strings.ToLower(fields[1])] = v
+  }
+  return lut, nil
+}
+
+// the lookup table given by --lut or the aseg labels
+func readLUT( fn string ) ( lookupTable, error ) {
+  if fn == "" {
+    return parseLUT(asegLUT)
+  }
+  buf, err := ioutil.ReadFile(fn)
+  if err != nil {
+    return lookupTable{}, fmt.Errorf("could not read lookup table %s", fn)
+  }
+  lut, err := parseLUT(string(buf))
+  if err != nil {
+    return lut, fmt.Errorf("could not parse lookup table %s (%s)", fn, err)
+  }
+  return lut, nil
+}
+
+// label value for a number or a name of the lookup table (case insensitive)
+func (lut lookupTable) resolve( s string ) ( int, error ) {
+  if v, err := strconv.Atoi(s); err == nil {
+    return v, nil
+  }
+  name := strings.ToLower(s)
+  if v, ok := lut.index[name]; ok {
+    return v, nil
+  }
+  if v, ok := lut.index[lutAliases[name]]; ok {
+    return v, nil
+  }
+  return 0, fmt.Errorf("unknown label %s (not a number and not in the lookup table)", s)
+}
+
+// name of a label for messages, numbers without a name are shown as such
+func (lut lookupTable) name( v int ) ( string ) {
+  if n, ok := lut.names[v]; ok {
+    return fmt.Sprintf("%d (%s)", v, n)
+  }
+  return fmt.Sprintf("%d", v)
+}
+
+// Label values of the --temp0, --temp1 and --simulate options, each can be a number or
+// a name in the lookup table (--lut). The resolved labels are shown in verbose mode.
+func resolveLabels( c *cli.Context, verbose bool ) ( []int, []int, []int, error ) {
+  lut, err := readLUT(c.String("lut"))
+  if err != nil {
+    return nil, nil, nil, err
+  }
+  var lists [3][]int
+  for n, name := range []string{"temp0", "temp1", "simulate"} {
+    var names []string
+    for _, s := range c.StringSlice(name) {
+      v, err := lut.resolve(s)
+      if err != nil {
+        return nil, nil, nil, fmt.Errorf("--%s: %s", name, err)
+      }
+      lists[n] = append(lists[n], v)
+      names = append(names, lut.name(v))
+    }
+    if verbose {
+      p(fmt.Sprintf("%s labels: %s", name, strings.Join(names, ", ")))
+    }
+  }
+  return lists[0], lists[1], lists[2], nil
+}
+
+// a list of labels in a config file, numbers or names
+type labelList []string
+
+// accept numbers and strings in json files (yaml converts numbers to strings)
+func (l *labelList) UnmarshalJSON( buf []byte ) ( error ) {
+  var values []interface{}
+  if err := json.Unmarshal(buf, &values); err != nil {
+    return err
+  }
+  *l = nil
+  for _, v := range values {
+    switch t := v.(type) {
+    case float64:
+      *l = append(*l, strconv.Itoa(int(t)))
+    case string:
+      *l = append(*l, t)
+    default:
+      return fmt.Errorf("label %v is not a number or a name", v)
+    }
+  }
+  return nil
+}
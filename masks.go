@@ -0,0 +1,145 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "github.com/codegangsta/cli"
+)
+
+// regions given as binary masks instead of (or in addition to) label values
+var maskRegions = []string{"temp0", "temp1", "simulate"}
+
+// options for boundaries and simulated regions from separate mask files
+func maskFlags() ( []cli.Flag ) {
+  return []cli.Flag{
+    cli.StringFlag {
+      Name: "temp0-mask",
+      Value: "",
+      Usage: "Binary mask (same voxel grid as the label field) of voxel with the low temperature, in addition to --temp0",
+    },
+    cli.StringFlag {
+      Name: "temp1-mask",
+      Value: "",
+      Usage: "Binary mask of voxel with the high temperature, in addition to --temp1",
+    },
+    cli.StringFlag {
+      Name: "simulate-mask",
+      Value: "",
+      Usage: "Binary mask of voxel for which the heat equation will be solved, in addition to --simulate",
+    },
+  }
+}
+
+// true if both volumes share the voxel grid and its position in scanner space
+func sameGeometry( a header, b header ) ( bool ) {
+  if !sameDimensions(a, b) {
+    return false
+  }
+  a = explicitGeometry(a)
+  b = explicitGeometry(b)
+  close := func( x float32, y float32 ) ( bool ) {
+    return math.Abs(float64(x-y)) < 1e-3
+  }
+  for c := 0; c < 3; c++ {
+    if !close(a.vz[c], b.vz[c]) || !close(a.Pxyz[c], b.Pxyz[c]) {
+      return false
+    }
+  }
+  for c := 0; c < 9; c++ {
+    if !close(a.Mdc[c], b.Mdc[c]) {
+      return false
+    }
+  }
+  return true
+}
+
+// label values that are neither in the label field nor in one of the lists
+func unusedLabels( labels [][][]uint8, lists ...[]int ) ( []int ) {
+  var used [256]bool
+  for k := range labels {
+    for j := range labels[k] {
+      for i := range labels[k][j] {
+        used[labels[k][j][i]] = true
+      }
+    }
+  }
+  for _, list := range lists {
+    for _, l := range list {
+      if l >= 0 && l < 256 {
+        used[l] = true
+      }
+    }
+  }
+  var free []int
+  for l := 255; l > 0; l-- {
+    if !used[l] {
+      free = append(free, l)
+    }
+  }
+  return free
+}
+
+// Add the masks of --temp0-mask, --temp1-mask and --simulate-mask to the label field. The voxel of each
+// mask get a label value that is not used otherwise and this label is added to the temp0, temp1 or
+// simulate labels. Masks are applied in the order simulate, temp1, temp0 so that boundary voxel win
+// where masks overlap. Returns the new lists and a description of the masks for the sidecars.
+func applyMasks( c *cli.Context, labels [][][]uint8, head header, temp0 []int, temp1 []int, sim []int, verbose bool ) ( []int, []int, []int, map[string]interface{}, error ) {
+  lists := map[string][]int{"temp0": temp0, "temp1": temp1, "simulate": sim}
+  info := map[string]interface{}{}
+  free := unusedLabels(labels, temp0, temp1, sim)
+  var painted [256]bool
+  for n := len(maskRegions)-1; n >= 0; n-- {
+    region := maskRegions[n]
+    fn := c.String(region + "-mask")
+    if fn == "" {
+      continue
+    }
+    if len(free) == 0 {
+      return temp0, temp1, sim, info, fmt.Errorf("no unused label value left for --%s-mask", region)
+    }
+    mask, mhead := readMGHfloat(fn, verbose)
+    if !sameGeometry(head, mhead) {
+      return temp0, temp1, sim, info, fmt.Errorf("--%s-mask %s and the label field have a different geometry", region, fn)
+    }
+    l := free[0]
+    free = free[1:]
+    voxels, overlap := 0, 0
+    for k := range mask {
+      for j := range mask[k] {
+        for i := range mask[k][j] {
+          if mask[k][j][i] == 0 {
+            continue
+          }
+          if painted[labels[k][j][i]] {
+            overlap = overlap + 1
+          }
+          labels[k][j][i] = uint8(l)
+          voxels = voxels + 1
+        }
+      }
+    }
+    painted[l] = true
+    lists[region] = append(lists[region], l)
+    if verbose {
+      p(fmt.Sprintf("%s mask %s: %d voxel with label %d", region, fn, voxels, l))
+    }
+    if overlap > 0 {
+      p(fmt.Sprintf("Warning: %d voxel of --%s-mask are also in another mask, they are %s voxel", overlap, region, region))
+    }
+    info[region] = map[string]interface{}{"Path": fn, "SHA256": fileSHA256(fn), "Label": l, "Voxels": voxels}
+  }
+  return lists["temp0"], lists["temp1"], lists["simulate"], info, nil
+}
+
+// path and SHA256 of each mask in the description of applyMasks, the masks of a checkpoint
+func maskFiles( info map[string]interface{} ) ( map[string][2]string ) {
+  if len(info) == 0 {
+    return nil
+  }
+  files := map[string][2]string{}
+  for region, m := range info {
+    fields := m.(map[string]interface{})
+    files[region] = [2]string{fields["Path"].(string), fields["SHA256"].(string)}
+  }
+  return files
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+  "github.com/codegangsta/cli"
+)
+
+// options to edit the label field before the simulation
+func preprocessFlags() ( []cli.Flag ) {
+  return []cli.Flag{
+    cli.StringSliceFlag {
+      Name: "merge",
+      Value: &cli.StringSlice{},
+      Usage: "Merge labels into another label before the simulation, FROM:TO with a comma separated list of labels FROM (e.g. 77:2). Can be specified more than once.",
+    },
+    cli.StringSliceFlag {
+      Name: "fill-holes",
+      Value: &cli.StringSlice{},
+      Usage: "Fill holes (enclosed regions of other labels up to --max-hole voxel) in this label. Can be specified more than once.",
+    },
+    cli.IntFlag {
+      Name: "max-hole",
+      Value: 100,
+      Usage: "Largest hole in voxel filled by --fill-holes",
+    },
+    cli.IntFlag {
+      Name: "min-component",
+      Value: 0,
+      Usage: "Merge connected components of the temp0, temp1 and simulated labels with less voxel into their neighbors",
+    },
+    cli.StringSliceFlag {
+      Name: "erode",
+      Value: &cli.StringSlice{},
+      Usage: "Erode a label by N voxel, LABEL[:N] (removes single voxel bridges). Can be specified more than once.",
+    },
+    cli.StringSliceFlag {
+      Name: "dilate",
+      Value: &cli.StringSlice{},
+      Usage: "Dilate a label by N voxel, LABEL[:N]. Can be specified more than once.",
+    },
+  }
+}
+
+// a label and the number of voxel for erosion or dilation
+type labelSteps struct {
+  label, steps int
+}
+
+// Edits of the label field before the simulation, applied in the order merge, fill holes,
+// remove small components, erode and dilate. All steps use 6-connectivity.
+type labelEdits struct {
+  merge [256]int   // new label of each label
+  merged bool
+  lut lookupTable   // label names for the messages
+  fillHoles []int
+  maxHole int
+  minComponent int
+  erode, dilate []labelSteps
+}
+
+// parse the options of preprocessFlags, label names are resolved with the lookup table (--lut)
+func parseLabelEdits( c *cli.Context ) ( labelEdits, error ) {
+  var e labelEdits
+  for v := range e.merge {
+    e.merge[v] = v
+  }
+  lut, err := readLUT(c.String("lut"))
+  if err != nil {
+    return e, err
+  }
+  e.lut = lut
+  // labels of the uint8 label field
+  label := func( name string, s string ) ( int, error ) {
+    v, err := lut.resolve(s)
+    if err != nil {
+      return 0, fmt.Errorf("--%s: %s", name, err)
+    }
+    if v < 0 || v > 255 {
+      return 0, fmt.Errorf("--%s: label %d is not between 0 and 255", name, v)
+    }
+    return v, nil
+  }
+  for _, s := range c.StringSlice("merge") {
+    parts := strings.Split(s, ":")
+    if len(parts) != 2 {
+      return e, fmt.Errorf("--merge %s has to be FROM:TO", s)
+    }
+    to, err := label("merge", parts[1])
+    if err != nil {
+      return e, err
+    }
+    for _, f := range strings.Split(parts[0], ",") {
+      from, err := label("merge", f)
+      if err != nil {
+        return e, err
+      }
+      if e.merge[from] != from && e.merge[from] != to {
+        return e, fmt.Errorf("--merge: label %s is mapped to %s and %s", lut.name(from), lut.name(e.merge[from]), lut.name(to))
+      }
+      e.merge[from] = to
+      e.merged = true
+    }
+  }
+  for _, s := range c.StringSlice("fill-holes") {
+    v, err := label("fill-holes", s)
+    if err != nil {
+      return e, err
+    }
+    e.fillHoles = append(e.fillHoles, v)
+  }
+  e.maxHole = c.Int("max-hole")
+  e.minComponent = c.Int("min-component")
+  for _, name := range []string{"erode", "dilate"} {
+    for _, s := range c.StringSlice(name) {
+      parts := strings.Split(s, ":")
+      v, err := label(name, parts[0])
+      if err != nil {
+        return e, err
+      }
+      ls := labelSteps{label: v, steps: 1}
+      if len(parts) == 2 {
+        ls.steps, err = strconv.Atoi(parts[1])
+      }
+      if len(parts) > 2 || err != nil || ls.steps < 1 {
+        return e, fmt.Errorf("--%s %s has to be LABEL or LABEL:N with N > 0", name, s)
+      }
+      if name == "erode" {
+        e.erode = append(e.erode, ls)
+      } else {
+        e.dilate = append(e.dilate, ls)
+      }
+    }
+  }
+  return e, nil
+}
+
+// Apply the edits to the label field, the labels in lists (temp0, temp1 and simulate) are checked for
+// small components. Returns a description of each step for the verbose output and the sidecars.
+func (e labelEdits) apply( labels [][][]uint8, verbose bool, lists ...[]int ) ( []string ) {
+  var steps []string
+  if e.merged {
+    var changed [256]int
+    var listed [256]bool // temp0, temp1 and simulated labels
+    for _, list := range lists {
+      for _, l := range list {
+        if l >= 0 && l < 256 {
+          listed[l] = true
+        }
+      }
+    }
+    for k := range labels {
+      for j := range labels[k] {
+        for i := range labels[k][j] {
+          if v := e.merge[labels[k][j][i]]; v != int(labels[k][j][i]) {
+            changed[labels[k][j][i]] = changed[labels[k][j][i]] + 1
+            labels[k][j][i] = uint8(v)
+          }
+        }
+      }
+    }
+    for v, to := range e.merge {
+      if to != v {
+        steps = append(steps, fmt.Sprintf("merged %s -> %s (%d voxel)", e.lut.name(v), e.lut.name(to), changed[v]))
+        if listed[v] {
+          p(fmt.Sprintf("Warning: temp0, temp1 or simulated label %s is merged into %s before the simulation", e.lut.name(v), e.lut.name(to)))
+        }
+      }
+    }
+  }
+  for _, l := range e.fillHoles {
+    holes, voxels := fillHoles(labels, l, e.maxHole)
+    steps = append(steps, fmt.Sprintf("filled %d holes (%d voxel) in label %d", holes, voxels, l))
+  }
+  if e.minComponent > 0 {
+    var use [256]bool
+    for _, list := range lists {
+      for _, l := range list {
+        if l >= 0 && l < 256 && !use[l] {
+          use[l] = true
+          n, voxels := removeSmallComponents(labels, l, e.minComponent)
+          steps = append(steps, fmt.Sprintf("merged %d components (%d voxel) of label %d with less than %d voxel into their neighbors", n, voxels, l, e.minComponent))
+        }
+      }
+    }
+  }
+  for _, ls := range e.erode {
+    voxels := 0
+    for s := 0; s < ls.steps; s++ {
+      voxels = voxels + erodeLabel(labels, ls.label)
+    }
+    steps = append(steps, fmt.Sprintf("eroded label %d by %d voxel (%d voxel)", ls.label, ls.steps, voxels))
+  }
+  for _, ls := range e.dilate {
+    voxels := 0
+    for s := 0; s < ls.steps; s++ {
+      voxels = voxels + dilateLabel(labels, ls.label)
+    }
+    steps = append(steps, fmt.Sprintf("dilated label %d by %d voxel (%d voxel)", ls.label, ls.steps, voxels))
+  }
+  if verbose {
+    for _, s := range steps {
+      p(s)
+    }
+  }
+  return steps
+}
+
+// 6-connected neighbors used by all edits
+var faceOffsets = neighborOffsets(6)
+
+// voxel with the label l (inside) or with another label (not inside) are 1
+func labelMask( labels [][][]uint8, l int, inside bool ) ( [][][]uint8 ) {
+  mask := make([][][]uint8, len(labels))
+  for k := range labels {
+    mask[k] = make([][]uint8, len(labels[k]))
+    for j := range labels[k] {
+      mask[k][j] = make([]uint8, len(labels[k][j]))
+      for i := range labels[k][j] {
+        if (int(labels[k][j][i]) == l) == inside {
+          mask[k][j][i] = 1
+        }
+      }
+    }
+  }
+  return mask
+}
+
+// size of each component and whether it touches the border of the volume
+func componentSizes( comp [][][]int32, n int ) ( []int, []bool ) {
+  sizes := make([]int, n+1)
+  border := make([]bool, n+1)
+  for k := range comp {
+    for j := range comp[k] {
+      for i := range comp[k][j] {
+        c := comp[k][j][i]
+        sizes[c] = sizes[c] + 1
+        if k == 0 || j == 0 || i == 0 || k == len(comp)-1 || j == len(comp[k])-1 || i == len(comp[k][j])-1 {
+          border[c] = true
+        }
+      }
+    }
+  }
+  return sizes, border
+}
+
+// Regions of other labels up to maxHole voxel that are enclosed by label l (do not touch the
+// border of the volume) get the label l. Returns the number of holes and voxel filled.
+func fillHoles( labels [][][]uint8, l int, maxHole int ) ( int, int ) {
+  comp, n := connectedComponents(labelMask(labels, l, false), 6)
+  sizes, border := componentSizes(comp, n)
+  holes, voxels := 0, 0
+  fill := make([]bool, n+1)
+  for c := 1; c <= n; c++ {
+    if !border[c] && sizes[c] <= maxHole {
+      fill[c] = true
+      holes = holes + 1
+      voxels = voxels + sizes[c]
+    }
+  }
+  for k := range comp {
+    for j := range comp[k] {
+      for i := range comp[k][j] {
+        if fill[comp[k][j][i]] {
+          labels[k][j][i] = uint8(l)
+        }
+      }
+    }
+  }
+  return holes, voxels
+}
+
+// the most frequent label of the face neighbors of (k,j,i) that is not l, l if there is none
+func neighborLabel( labels [][][]uint8, k int, j int, i int, l int ) ( int ) {
+  var counts [256]int
+  best := l
+  for _, o := range faceOffsets {
+    kk, jj, ii := k+o[0], j+o[1], i+o[2]
+    if kk < 0 || jj < 0 || ii < 0 || kk >= len(labels) || jj >= len(labels[0]) || ii >= len(labels[0][0]) {
+      continue
+    }
+    v := int(labels[kk][jj][ii])
+    if v == l {
+      continue
+    }
+    counts[v] = counts[v] + 1
+    if best == l || counts[v] > counts[best] {
+      best = v
+    }
+  }
+  return best
+}
+
+// Components of label l with less than minSize voxel get the most frequent label around them.
+// Returns the number of components and voxel merged.
+func removeSmallComponents( labels [][][]uint8, l int, minSize int ) ( int, int ) {
+  comp, n := connectedComponents(labelMask(labels, l, true), 6)
+  sizes, _ := componentSizes(comp, n)
+  counts := make(map[int32]*[256]int)
+  for c := 1; c <= n; c++ {
+    if sizes[c] < minSize {
+      counts[int32(c)] = &[256]int{}
+    }
+  }
+  if len(counts) == 0 {
+    return 0, 0
+  }
+  // labels around each small component
+  for k := range comp {
+    for j := range comp[k] {
+      for i := range comp[k][j] {
+        cnt, ok := counts[comp[k][j][i]]
+        if !ok {
+          continue
+        }
+        for _, o := range faceOffsets {
+          kk, jj, ii := k+o[0], j+o[1], i+o[2]
+          if kk < 0 || jj < 0 || ii < 0 || kk >= len(labels) || jj >= len(labels[0]) || ii >= len(labels[0][0]) {
+            continue
+          }
+          if v := int(labels[kk][jj][ii]); v != l {
+            cnt[v] = cnt[v] + 1
+          }
+        }
+      }
+    }
+  }
+  merged := 0
+  for k := range comp {
+    for j := range comp[k] {
+      for i := range comp[k][j] {
+        cnt, ok := counts[comp[k][j][i]]
+        if !ok {
+          continue
+        }
+        best := -1
+        for v := range cnt {
+          if cnt[v] > 0 && (best < 0 || cnt[v] > cnt[best]) {
+            best = v
+          }
+        }
+        if best >= 0 {
+          labels[k][j][i] = uint8(best)
+          merged = merged + 1
+        }
+      }
+    }
+  }
+  return len(counts), merged
+}
+
+// one voxel erosion of label l, voxel at the border of l get their most frequent other
+// neighbor label, returns the number of voxel changed
+func erodeLabel( labels [][][]uint8, l int ) ( int ) {
+  type change struct {
+    k, j, i int
+    v uint8
+  }
+  var changes []change
+  for k := range labels {
+    for j := range labels[k] {
+      for i := range labels[k][j] {
+        if int(labels[k][j][i]) != l {
+          continue
+        }
+        if v := neighborLabel(labels, k, j, i, l); v != l {
+          changes = append(changes, change{k, j, i, uint8(v)})
+        }
+      }
+    }
+  }
+  for _, c := range changes {
+    labels[c.k][c.j][c.i] = c.v
+  }
+  return len(changes)
+}
+
+// one voxel dilation of label l into all face neighbors, returns the number of voxel changed
+func dilateLabel( labels [][][]uint8, l int ) ( int ) {
+  var changes [][3]int
+  for k := range labels {
+    for j := range labels[k] {
+      for i := range labels[k][j] {
+        if int(labels[k][j][i]) == l {
+          continue
+        }
+        for _, o := range faceOffsets {
+          kk, jj, ii := k+o[0], j+o[1], i+o[2]
+          if kk < 0 || jj < 0 || ii < 0 || kk >= len(labels) || jj >= len(labels[0]) || ii >= len(labels[0][0]) {
+            continue
+          }
+          if int(labels[kk][jj][ii]) == l {
+            changes = append(changes, [3]int{k, j, i})
+            break
+          }
+        }
+      }
+    }
+  }
+  for _, c := range changes {
+    labels[c[0]][c[1]][c[2]] = uint8(l)
+  }
+  return len(changes)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "math"
+  "strings"
+  "io/ioutil"
+  "compress/gzip"
+  "encoding/binary"
+)
+
+// NIfTI-1 support (.nii and .nii.gz), the geometry is converted to and from the
+// mgh representation (voxel size, direction cosines and center of the volume)
+
+// true if the file name has a nifti extension
+func isNIfTI( fn string ) ( bool ) {
+  return strings.HasSuffix(fn, ".nii") || strings.HasSuffix(fn, ".nii.gz")
+}
+
+// read the first volume of a nifti file as floating point values
+func readNIfTIfloat( fn string, verbose bool ) ( [][][]float32, header ) {
+  var head header
+  fi, err := os.Open(fn)
+  if err != nil {
+    p(fmt.Sprintf("Error: could not open file %s", fn))
+    os.Exit(-1)
+  }
+  defer fi.Close()
+  var buf []byte
+  if strings.HasSuffix(fn, ".gz") {
+    fz, err := gzip.NewReader(fi)
+    if err != nil {
+      p(fmt.Sprintf("Error: could not uncompress file %s", fn))
+      os.Exit(-1)
+    }
+    defer fz.Close()
+    buf, err = ioutil.ReadAll(fz)
+  } else {
+    buf, err = ioutil.ReadAll(fi)
+  }
+  if err != nil || len(buf) < 348 {
+    p(fmt.Sprintf("Error: could not read nifti header from %s", fn))
+    os.Exit(-1)
+  }
+
+  var order binary.ByteOrder = binary.LittleEndian
+  if order.Uint32(buf[0:]) != 348 {
+    order = binary.BigEndian
+    if order.Uint32(buf[0:]) != 348 {
+      p(fmt.Sprintf("Error: %s is not a nifti-1 file", fn))
+      os.Exit(-1)
+    }
+  }
+  i16 := func( o int ) ( int ) { return int(int16(order.Uint16(buf[o:]))) }
+  f32 := func( o int ) ( float32 ) { return math.Float32frombits(order.Uint32(buf[o:])) }
+
+  var dims [3]int
+  for c := 0; c < 3; c++ {
+    dims[c] = i16(42 + 2*c)
+    if dims[c] < 1 || c >= i16(40) {
+      dims[c] = 1
+    }
+  }
+  datatype := i16(70)
+  voxOffset := int(f32(108))
+  slope := f32(112)
+  inter := f32(116)
+  if slope == 0 {
+    slope = 1
+    inter = 0
+  }
+  var pixdim [4]float32
+  for c := 0; c < 4; c++ {
+    pixdim[c] = f32(76 + 4*c)
+  }
+
+  // voxel to ras transformation from sform, qform or the voxel size only
+  var m [3][4]float64
+  if i16(254) > 0 {
+    for r := 0; r < 3; r++ {
+      for c := 0; c < 4; c++ {
+        m[r][c] = float64(f32(280 + 16*r + 4*c))
+      }
+    }
+  } else if i16(252) > 0 {
+    b := float64(f32(256))
+    c := float64(f32(260))
+    d := float64(f32(264))
+    a := math.Sqrt(math.Max(0, 1 - (b*b + c*c + d*d)))
+    rot := [3][3]float64{
+      {a*a + b*b - c*c - d*d, 2*(b*c - a*d), 2*(b*d + a*c)},
+      {2*(b*c + a*d), a*a + c*c - b*b - d*d, 2*(c*d - a*b)},
+      {2*(b*d - a*c), 2*(c*d + a*b), a*a + d*d - c*c - b*b},
+    }
+    qfac := 1.0
+    if pixdim[0] < 0 {
+      qfac = -1
+    }
+    for r := 0; r < 3; r++ {
+      for col := 0; col < 3; col++ {
+        m[r][col] = rot[r][col] * float64(pixdim[col+1])
+      }
+      m[r][2] = m[r][2] * qfac
+      m[r][3] = float64(f32(268 + 4*r))
+    }
+  } else {
+    for c := 0; c < 3; c++ {
+      m[c][c] = float64(pixdim[c+1])
+    }
+  }
+
+  head.version = 1
+  head.width   = int32(dims[0])
+  head.height  = int32(dims[1])
+  head.depth   = int32(dims[2])
+  head.nframes = 1
+  head.dof     = 1
+  head.t       = 0
+  if datatype == 16 || datatype == 64 {
+    head.t = 3
+  }
+  head.goodRASFlag = 1
+  for c := 0; c < 3; c++ {
+    l := math.Sqrt(m[0][c]*m[0][c] + m[1][c]*m[1][c] + m[2][c]*m[2][c])
+    if l == 0 {
+      l = 1
+    }
+    head.vz[c] = float32(l)
+    for r := 0; r < 3; r++ {
+      head.Mdc[c*3+r] = float32(m[r][c] / l)
+    }
+  }
+  for r := 0; r < 3; r++ {
+    head.Pxyz[r] = float32(m[r][3] + m[r][0]*float64(dims[0])/2 + m[r][1]*float64(dims[1])/2 + m[r][2]*float64(dims[2])/2)
+  }
+  if verbose {
+    p(fmt.Sprintf("Input data: [nifti, width: %d, height: %d, depth: %d, datatype: %d]", head.width, head.height, head.depth, datatype))
+  }
+
+  var size int
+  var value func( o int ) ( float32 )
+  switch datatype {
+  case 2: // unsigned char
+    size = 1
+    value = func( o int ) ( float32 ) { return float32(buf[o]) }
+  case 256: // signed char
+    size = 1
+    value = func( o int ) ( float32 ) { return float32(int8(buf[o])) }
+  case 4: // signed short
+    size = 2
+    value = func( o int ) ( float32 ) { return float32(int16(order.Uint16(buf[o:]))) }
+  case 512: // unsigned short
+    size = 2
+    value = func( o int ) ( float32 ) { return float32(order.Uint16(buf[o:])) }
+  case 8: // signed int
+    size = 4
+    value = func( o int ) ( float32 ) { return float32(int32(order.Uint32(buf[o:]))) }
+  case 16: // float
+    size = 4
+    value = func( o int ) ( float32 ) { return math.Float32frombits(order.Uint32(buf[o:])) }
+  case 64: // double
+    size = 8
+    value = func( o int ) ( float32 ) { return float32(math.Float64frombits(order.Uint64(buf[o:]))) }
+  default:
+    p(fmt.Sprintf("Error: nifti datatype %d is not supported", datatype))
+    os.Exit(-1)
+  }
+  if voxOffset + size*dims[0]*dims[1]*dims[2] > len(buf) {
+    p(fmt.Sprintf("Error: could not read all data from file %s", fn))
+    os.Exit(-1)
+  }
+
+  field := make([][][]float32, dims[2])
+  o := voxOffset
+  for k := range field {
+    field[k] = make([][]float32, dims[1])
+    for j := range field[k] {
+      field[k][j] = make([]float32, dims[0])
+      for i := range field[k][j] {
+        field[k][j][i] = value(o)*slope + inter
+        o = o + size
+      }
+    }
+  }
+  return field, head
+}
+
+// quaternion representation (b, c, d and qfac) of the rotation part of the mgh geometry
+func quaternion( mdc [9]float32 ) ( [3]float64, float64 ) {
+  var r [3][3]float64
+  for row := 0; row < 3; row++ {
+    for col := 0; col < 3; col++ {
+      r[row][col] = float64(mdc[col*3+row])
+    }
+  }
+  qfac := 1.0
+  det := r[0][0]*(r[1][1]*r[2][2]-r[1][2]*r[2][1]) - r[0][1]*(r[1][0]*r[2][2]-r[1][2]*r[2][0]) + r[0][2]*(r[1][0]*r[2][1]-r[1][1]*r[2][0])
+  if det < 0 {
+    qfac = -1
+    for row := 0; row < 3; row++ {
+      r[row][2] = -r[row][2]
+    }
+  }
+  var a, b, c, d float64
+  a = r[0][0] + r[1][1] + r[2][2] + 1
+  if a > 0.5 {
+    a = 0.5 * math.Sqrt(a)
+    b = 0.25 * (r[2][1] - r[1][2]) / a
+    c = 0.25 * (r[0][2] - r[2][0]) / a
+    d = 0.25 * (r[1][0] - r[0][1]) / a
+  } else {
+    xd := 1 + r[0][0] - (r[1][1] + r[2][2])
+    yd := 1 + r[1][1] - (r[0][0] + r[2][2])
+    zd := 1 + r[2][2] - (r[0][0] + r[1][1])
+    if xd > 1 {
+      b = 0.5 * math.Sqrt(xd)
+      c = 0.25 * (r[0][1] + r[1][0]) / b
+      d = 0.25 * (r[0][2] + r[2][0]) / b
+      a = 0.25 * (r[2][1] - r[1][2]) / b
+    } else if yd > 1 {
+      c = 0.5 * math.Sqrt(yd)
+      b = 0.25 * (r[0][1] + r[1][0]) / c
+      d = 0.25 * (r[1][2] + r[2][1]) / c
+      a = 0.25 * (r[0][2] - r[2][0]) / c
+    } else {
+      d = 0.5 * math.Sqrt(zd)
+      b = 0.25 * (r[0][2] + r[2][0]) / d
+      c = 0.25 * (r[1][2] + r[2][1]) / d
+      a = 0.25 * (r[1][0] - r[0][1]) / d
+    }
+    if a < 0 {
+      b = -b
+      c = -c
+      d = -d
+    }
+  }
+  return [3]float64{b, c, d}, qfac
+}
+
+// the 352 byte nifti-1 header (including an empty extension) for a volume with the
+// geometry of head, typ is the mgh data type (0 - unsigned char, 3 - float)
+func niftiHeader( head header, typ int32, nframes int32 ) ( []byte ) {
+  hdr := make([]byte, 352)
+  le := binary.LittleEndian
+  put16 := func( o int, v int ) { le.PutUint16(hdr[o:], uint16(int16(v))) }
+  putf  := func( o int, v float64 ) { le.PutUint32(hdr[o:], math.Float32bits(float32(v))) }
+
+  le.PutUint32(hdr[0:], 348)
+  if nframes > 1 {
+    put16(40, 4)
+  } else {
+    put16(40, 3)
+  }
+  put16(42, int(head.width))
+  put16(44, int(head.height))
+  put16(46, int(head.depth))
+  put16(48, int(nframes))
+  put16(50, 1)
+  put16(52, 1)
+  if typ == 0 {
+    put16(70, 2)
+    put16(72, 8)
+  } else {
+    put16(70, 16)
+    put16(72, 32)
+  }
+  m := vox2ras(head)
+  vz := head.vz
+  mdc := head.Mdc
+  if head.goodRASFlag != 1 {
+    vz = [3]float32{1, 1, 1}
+    for c := 0; c < 3; c++ {
+      for r := 0; r < 3; r++ {
+        mdc[c*3+r] = m[r][c]
+      }
+    }
+  }
+  q, qfac := quaternion(mdc)
+  putf(76, qfac)
+  for c := 0; c < 3; c++ {
+    putf(80 + 4*c, float64(vz[c]))
+  }
+  putf(92, 1)
+  putf(108, 352) // vox_offset
+  putf(112, 1)   // scl_slope
+  hdr[123] = 2   // xyzt_units: mm
+  copy(hdr[148:228], "heat")
+  put16(252, 1) // qform_code: scanner
+  put16(254, 1) // sform_code: scanner
+  for c := 0; c < 3; c++ {
+    putf(256 + 4*c, q[c])
+    putf(268 + 4*c, float64(m[c][3]))
+  }
+  for r := 0; r < 3; r++ {
+    for c := 0; c < 4; c++ {
+      putf(280 + 16*r + 4*c, float64(m[r][c]))
+    }
+  }
+  copy(hdr[344:348], "n+1\x00")
+  return hdr
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "path"
+  "strings"
+  "github.com/codegangsta/cli"
+)
+
+// outputs of the 'on' command and the suffix appended to the base name of the input
+var outputSuffixes = [][2]string{
+  {"temperature", "_temperatur.mgz"},
+  {"label", "_label.mgz"},
+  {"gradient", "_gradient.mgz"},
+  {"direction", "_direction.mgz"},
+  {"magnitude", "_magnitude.mgz"},
+  {"thickness", "_thickness.mgz"},
+  {"L0", "_L0.mgz"},
+  {"L1", "_L1.mgz"},
+  {"depth", "_depth.mgz"},
+  {"equivolume", "_equivolume.mgz"},
+  {"streamlines", "_streamlines.trk"},
+  {"checkpoint", "_checkpoint.mgz"},
+}
+
+// options that control where output files are written
+func outputLocationFlags() ( []cli.Flag ) {
+  return []cli.Flag{
+    cli.StringFlag {
+      Name: "outdir",
+      Value: "",
+      Usage: "Directory for the output files (default: directory of the input)",
+    },
+    cli.StringFlag {
+      Name: "prefix",
+      Value: "",
+      Usage: "Base name of the output files (default: input file name without extension)",
+    },
+    cli.BoolFlag {
+      Name: "force",
+      Usage: "Overwrite existing output files",
+    },
+  }
+}
+
+// write outputs as a BIDS derivatives dataset
+func bidsFlags() ( []cli.Flag ) {
+  return []cli.Flag{
+    cli.BoolFlag {
+      Name: "bids",
+      Usage: "Write outputs of a BIDS input to <dataset>/derivatives/heat with json sidecars (--outdir sets the derivatives folder)",
+    },
+  }
+}
+
+// explicit file names for each output of the 'on' command (--out-temperature etc.)
+func outputFileFlags() ( []cli.Flag ) {
+  var flags []cli.Flag
+  for _, o := range outputSuffixes {
+    if o[0] == "streamlines" || o[0] == "checkpoint" {
+      continue
+    }
+    flags = append(flags, cli.StringFlag {
+      Name: "out-" + o[0],
+      Value: "",
+      Usage: fmt.Sprintf("File name for the %s output (overrides --outdir and --prefix)", o[0]),
+    })
+  }
+  return flags
+}
+
+// remove the extension of a file name, double extensions like .nii.gz are removed as a whole
+func stripExtension( f string ) ( string ) {
+  for _, ext := range []string{".nii.gz", ".mgh.gz"} {
+    if strings.HasSuffix(f, ext) {
+      return f[0:len(f)-len(ext)]
+    }
+  }
+  return f[0:len(f)-len(path.Ext(f))]
+}
+
+// names of the output files of a run
+type outputNames struct {
+  c *cli.Context
+  dir, base string
+  bids *bidsInput // set for a BIDS derivatives layout
+}
+
+func newOutputNames( c *cli.Context, input string ) ( outputNames, error ) {
+  d, f := path.Split(input)
+  o := outputNames{c: c, dir: d, base: stripExtension(f)}
+  if c.Bool("bids") {
+    b, err := parseBIDSPath(input)
+    if err != nil {
+      return o, err
+    }
+    if c.String("outdir") != "" {
+      b.root = c.String("outdir")
+    }
+    o.bids = &b
+    o.dir = path.Join(b.root, b.subdir)
+    o.base = b.entities
+  } else if c.String("outdir") != "" {
+    o.dir = c.String("outdir")
+  }
+  if c.String("prefix") != "" {
+    o.base = c.String("prefix")
+  }
+  return o, nil
+}
+
+// file name for the output kind (see outputSuffixes)
+func (o outputNames) name( kind string ) ( string ) {
+  if fn := o.c.String("out-" + kind); fn != "" {
+    return fn
+  }
+  if d, ok := bidsDescriptions[kind]; ok && o.bids != nil {
+    suffix := o.bids.suffix
+    if kind == "label" {
+      suffix = "dseg"
+    }
+    return path.Join(o.dir, o.base + "_desc-" + d + "_" + suffix + ".nii.gz")
+  }
+  for _, s := range outputSuffixes {
+    if s[0] == kind {
+      return path.Join(o.dir, o.base + s[1])
+    }
+  }
+  return path.Join(o.dir, o.base + "_" + kind + ".mgz")
+}
+
+// Create the output directories and make sure that no existing file (or its sidecar) is
+// overwritten unless --force is set. Should be called before any work is done.
+func (o outputNames) prepare( kinds []string ) ( error ) {
+  for _, kind := range kinds {
+    for _, fn := range []string{o.name(kind), sidecarName(o.name(kind))} {
+      if err := o.prepareFile(fn); err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+// create the directory of a single output file and check if it exists already
+func (o outputNames) prepareFile( fn string ) ( error ) {
+  if d, _ := path.Split(fn); d != "" {
+    if err := os.MkdirAll(d, 0755); err != nil {
+      return fmt.Errorf("could not create output directory %s (%s)", d, err)
+    }
+  }
+  if _, err := os.Stat(fn); err == nil && !o.c.Bool("force") {
+    return fmt.Errorf("output file %s exists, use --force to overwrite", fn)
+  }
+  return nil
+}
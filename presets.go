@@ -0,0 +1,118 @@
+package main
+
+import (
+  "fmt"
+  "strings"
+  "github.com/codegangsta/cli"
+)
+
+// a named set of boundary and simulated labels for FreeSurfer's aseg.mgz
+type preset struct {
+  name, description string
+  temp0, temp1, simulate []int
+}
+
+var presets = []preset{
+  {
+    name: "lh-wm",
+    description: "Left hemisphere white matter between the cortex (temp0) and the ventricles/caudate (temp1)",
+    temp0: []int{3},
+    temp1: []int{11, 4, 77, 31, 5},
+    simulate: []int{2, 12, 13, 10, 30, 17, 18, 26},
+  },
+  {
+    name: "rh-wm",
+    description: "Right hemisphere white matter between the cortex (temp0) and the ventricles/caudate (temp1)",
+    temp0: []int{42},
+    temp1: []int{50, 43, 77, 63, 44},
+    simulate: []int{41, 51, 52, 49, 62, 53, 54, 58},
+  },
+  {
+    name: "both-wm",
+    description: "White matter of both hemispheres (lh-wm and rh-wm together)",
+    temp0: []int{3, 42},
+    temp1: []int{11, 4, 77, 31, 5, 50, 43, 63, 44},
+    simulate: []int{2, 12, 13, 10, 30, 17, 18, 26, 41, 51, 52, 49, 62, 53, 54, 58},
+  },
+  {
+    name: "cerebellum",
+    description: "Cerebellar white matter between the cerebellar cortex (temp0) and brain stem/4th ventricle (temp1)",
+    temp0: []int{8, 47},
+    temp1: []int{16, 15},
+    simulate: []int{7, 46},
+  },
+}
+
+// find a preset by name
+func findPreset( name string ) ( preset, bool ) {
+  for _, pr := range presets {
+    if pr.name == name {
+      return pr, true
+    }
+  }
+  return preset{}, false
+}
+
+func presetNames() ( []string ) {
+  var names []string
+  for _, pr := range presets {
+    names = append(names, pr.name)
+  }
+  return names
+}
+
+// the preset as command line options
+func (pr preset) options() ( string ) {
+  var opts []string
+  for _, l := range []struct{ flag string; labels []int }{{"--t0", pr.temp0}, {"--t1", pr.temp1}, {"--s", pr.simulate}} {
+    for _, v := range l.labels {
+      opts = append(opts, fmt.Sprintf("%s %d", l.flag, v))
+    }
+  }
+  return strings.Join(opts, " ")
+}
+
+// Use the labels of the --preset for --temp0, --temp1 and --simulate, each of them
+// can be replaced by giving the option on the command line (or in the config file).
+func applyPreset( c *cli.Context ) ( error ) {
+  if c.String("preset") == "" {
+    return nil
+  }
+  pr, ok := findPreset(c.String("preset"))
+  if !ok {
+    return fmt.Errorf("unknown preset %s, use one of %v (see 'heat presets')", c.String("preset"), presetNames())
+  }
+  for _, l := range []struct{ name string; labels []int }{{"temp0", pr.temp0}, {"temp1", pr.temp1}, {"simulate", pr.simulate}} {
+    if isSet(c, l.name) {
+      continue
+    }
+    for _, v := range l.labels {
+      c.Set(l.name, fmt.Sprintf("%d", v))
+    }
+  }
+  return nil
+}
+
+// print all presets or the presets given by name
+func showPresets( names []string ) ( error ) {
+  if len(names) == 0 {
+    names = presetNames()
+  }
+  lut, _ := parseLUT(asegLUT)
+  for _, name := range names {
+    pr, ok := findPreset(name)
+    if !ok {
+      return fmt.Errorf("unknown preset %s, use one of %v", name, presetNames())
+    }
+    fmt.Printf("%s\n  %s\n", pr.name, pr.description)
+    for _, l := range []struct{ name string; labels []int }{{"temp0", pr.temp0}, {"temp1", pr.temp1}, {"simulate", pr.simulate}} {
+      var values []string
+      for _, v := range l.labels {
+        values = append(values, lut.name(v))
+      }
+      fmt.Printf("  %-9s %s\n", l.name + ":", strings.Join(values, ", "))
+    }
+    fmt.Printf("  options:  %s\n\n", pr.options())
+  }
+  return nil
+}
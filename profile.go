@@ -0,0 +1,157 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "bufio"
+  "math"
+)
+
+// summary of a single connected lesion
+type lesionProfile struct {
+  voxels int
+  centroid [3]float64
+  inside int // voxel with a valid depth value
+  sumDepth, minDepth, maxDepth float64
+  shells []int // voxel per shell, index 0 is outside of all shells
+}
+
+// convert a temperature into a normalized depth, 0 at the --temp0 boundary and 1 at the --temp1 boundary
+func normalizedDepth( temperature float32 ) ( float64 ) {
+  return float64(temperature-lowTemperature) / float64(highTemperature-lowTemperature)
+}
+
+// Compute per lesion statistics of depth and shell membership. The field is either a
+// temperature field (isTemperature) or a shell label field. If shells is nil and the
+// field contains shell label the shell membership is taken from the field itself. Shell label
+// have to be between 0 and 255 (see 'on --label').
+func profileLesions( field [][][]float32, isTemperature bool, shells [][][]float32, lesions [][][]float32, connectivity int, verbose bool ) ( []lesionProfile, int, error ) {
+  var dims [3]int
+  dims[2] = len(lesions)
+  dims[1] = len(lesions[0])
+  dims[0] = len(lesions[0][0])
+
+  if shells == nil && !isTemperature {
+    shells = field
+  }
+  // the number of shells is the largest label found in the shell field (voxel of isolated
+  // components flagged by 'on --isolated flag' are not part of any shell)
+  numShells := 0
+  if shells != nil {
+    for k := range shells {
+      for j := range shells[k] {
+        for i := range shells[k][j] {
+          if !(shells[k][j][i] >= 0 && shells[k][j][i] <= 255) {
+            return nil, 0, fmt.Errorf("shell label %g at voxel (%d, %d, %d) is not between 0 and 255", shells[k][j][i], i, j, k)
+          }
+          if int(shells[k][j][i]) > numShells && shells[k][j][i] != float32(isolatedShell) {
+            numShells = int(shells[k][j][i])
+          }
+        }
+      }
+    }
+  }
+
+  mask := make([][][]uint8, dims[2])
+  for k := range mask {
+    mask[k] = make([][]uint8, dims[1])
+    for j := range mask[k] {
+      mask[k][j] = make([]uint8, dims[0])
+      for i := range mask[k][j] {
+        if lesions[k][j][i] != 0 {
+          mask[k][j][i] = 1
+        }
+      }
+    }
+  }
+  comp, n := connectedComponents(mask, connectivity)
+  if verbose {
+    p(fmt.Sprintf("found %d lesion(s) with %d-connectivity", n, connectivity))
+  }
+
+  profiles := make([]lesionProfile, n)
+  for l := range profiles {
+    profiles[l].minDepth = math.Inf(1)
+    profiles[l].maxDepth = math.Inf(-1)
+    profiles[l].shells = make([]int, numShells+1)
+  }
+  for k := range comp {
+    for j := range comp[k] {
+      for i := range comp[k][j] {
+        if comp[k][j][i] == 0 {
+          continue
+        }
+        pr := &profiles[comp[k][j][i]-1]
+        pr.voxels = pr.voxels + 1
+        pr.centroid[0] = pr.centroid[0] + float64(i)
+        pr.centroid[1] = pr.centroid[1] + float64(j)
+        pr.centroid[2] = pr.centroid[2] + float64(k)
+
+        // voxel outside of the simulated region have a value of 0 and no depth
+        if field[k][j][i] > 0 && (isTemperature || field[k][j][i] != float32(isolatedShell)) {
+          var depth float64
+          if isTemperature {
+            depth = normalizedDepth(field[k][j][i])
+          } else {
+            depth = (float64(field[k][j][i]) - 0.5) / float64(numShells)
+          }
+          pr.inside = pr.inside + 1
+          pr.sumDepth = pr.sumDepth + depth
+          pr.minDepth = math.Min(pr.minDepth, depth)
+          pr.maxDepth = math.Max(pr.maxDepth, depth)
+        }
+        if shells != nil && shells[k][j][i] != float32(isolatedShell) {
+          pr.shells[int(shells[k][j][i])] = pr.shells[int(shells[k][j][i])] + 1
+        }
+      }
+    }
+  }
+  for l := range profiles {
+    for c := range profiles[l].centroid {
+      profiles[l].centroid[c] = profiles[l].centroid[c] / float64(profiles[l].voxels)
+    }
+  }
+  return profiles, numShells, nil
+}
+
+// write the lesion profiles as comma separated values, to stdout if fn is empty
+func saveProfileCSV( profiles []lesionProfile, numShells int, fn string, verbose bool ) {
+  out := os.Stdout
+  if fn != "" {
+    if verbose {
+      p(fmt.Sprintf("writing file %s...", fn))
+    }
+    fi, err := os.Create(fn)
+    if err != nil {
+      p(fmt.Sprintf("Error: could not open file %s", fn))
+      os.Exit(-1)
+    }
+    defer fi.Close()
+    out = fi
+  }
+  w := bufio.NewWriter(out)
+  defer w.Flush()
+
+  fmt.Fprintf(w, "lesion,voxels,centroid_i,centroid_j,centroid_k,depth_voxels,mean_depth,min_depth,max_depth")
+  if numShells > 0 {
+    fmt.Fprintf(w, ",outside")
+    for s := 1; s <= numShells; s++ {
+      fmt.Fprintf(w, ",shell_%d", s)
+    }
+  }
+  fmt.Fprintf(w, "\n")
+  for l, pr := range profiles {
+    fmt.Fprintf(w, "%d,%d,%.2f,%.2f,%.2f,%d", l+1, pr.voxels, pr.centroid[0], pr.centroid[1], pr.centroid[2], pr.inside)
+    if pr.inside > 0 {
+      fmt.Fprintf(w, ",%.4f,%.4f,%.4f", pr.sumDepth/float64(pr.inside), pr.minDepth, pr.maxDepth)
+    } else {
+      fmt.Fprintf(w, ",,,")
+    }
+    if numShells > 0 {
+      for s := range pr.shells {
+        fmt.Fprintf(w, ",%d", pr.shells[s])
+      }
+    }
+    fmt.Fprintf(w, "\n")
+  }
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+  "os"
+  "io"
+  "fmt"
+  "math"
+  "time"
+  "runtime"
+  "crypto/sha256"
+)
+
+// Settings and environment of a run, stored in the json sidecar of each output so that
+// the version, command line, input and machine that produced a file can be traced.
+type provenance struct {
+  input, checksum string
+  head header
+  start time.Time
+}
+
+func newProvenance( input string ) ( provenance ) {
+  return provenance{input: input, checksum: fileSHA256(input), start: time.Now()}
+}
+
+// sha256 checksum of a file as hex string, empty if the file cannot be read
+func fileSHA256( fn string ) ( string ) {
+  fi, err := os.Open(fn)
+  if err != nil {
+    return ""
+  }
+  defer fi.Close()
+  h := sha256.New()
+  if _, err := io.Copy(h, fi); err != nil {
+    return ""
+  }
+  return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// json can not represent NaN and Inf (diverging simulations), they are stored as null
+func jsonFloat( v float32 ) ( interface{} ) {
+  if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+    return nil
+  }
+  return v
+}
+
+// the sidecar fields shared by all outputs of the run
+func (pv provenance) fields() ( map[string]interface{} ) {
+  host, _ := os.Hostname()
+  return map[string]interface{}{
+    "HeatVersion": version,
+    "CommandLine": os.Args,
+    "Input": map[string]interface{}{
+      "Path": pv.input,
+      "SHA256": pv.checksum,
+    },
+    "Geometry": geometryFields(pv.head),
+    "Timing": map[string]interface{}{
+      "Started": pv.start.Format(time.RFC3339),
+      "Seconds": time.Since(pv.start).Seconds(),
+    },
+    "Host": map[string]interface{}{
+      "Hostname": host,
+      "OS": runtime.GOOS,
+      "Arch": runtime.GOARCH,
+      "CPUs": runtime.NumCPU(),
+      "GOMAXPROCS": runtime.GOMAXPROCS(0),
+      "GoVersion": runtime.Version(),
+    },
+  }
+}
+
+// voxel grid of an output
+func geometryFields( head header ) ( map[string]interface{} ) {
+  m := vox2ras(head)
+  return map[string]interface{}{
+    "Dimensions": []int32{head.width, head.height, head.depth},
+    "VoxelSize": head.vz,
+    "Vox2RAS": [][4]float32{m[0], m[1], m[2], m[3]},
+    "GoodRASFlag": head.goodRASFlag,
+  }
+}
+
+// the solver settings and the convergence of the simulation, the distance methods only report their runtime
+func solverFields( method string, omega float64, iterations int, stats solverStats ) ( map[string]interface{} ) {
+  if !simulatedMethod(method) {
+    return map[string]interface{}{"Method": method, "Seconds": stats.elapsed.Seconds()}
+  }
+  fields := map[string]interface{}{
+    "Method": method,
+    "Stepsize": omega,
+    "IterationsRequested": iterations,
+    "Iterations": stats.iterations,
+    "Residual": jsonFloat(stats.residual),
+    "Seconds": stats.elapsed.Seconds(),
+  }
+  if stats.resumed > 0 {
+    fields["ResumedAt"] = stats.resumed
+  }
+  return fields
+}
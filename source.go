@@ -0,0 +1,93 @@
+package main
+
+import (
+  "fmt"
+  "strconv"
+)
+
+// A volumetric source term of the heat equation (--source), a constant or a volume with the source
+// of each voxel. With a source the steady state of the simulation is the solution of the Poisson
+// equation lap(T) = -s in the simulated voxel (s in temperature per mm^2).
+type sourceTerm struct {
+  constant float32
+  field [][][]float32 // source of each voxel, nil for a constant source
+  h2 float32          // squared voxel size (mm^2) of the simulation grid
+  description interface{}
+}
+
+// Parse --source, a number or a volume in the voxel grid of the label field (head). Returns nil
+// without a source.
+func parseSource( value string, head header, verbose bool ) ( *sourceTerm, error ) {
+  if value == "" {
+    return nil, nil
+  }
+  s := &sourceTerm{}
+  if v, err := strconv.ParseFloat(value, 32); err == nil {
+    if v == 0 {
+      return nil, nil
+    }
+    s.constant = float32(v)
+    s.description = v
+  } else {
+    field, fhead := readMGHfloat(value, verbose)
+    if !sameGeometry(head, fhead) {
+      return nil, fmt.Errorf("--source %s and the label field have a different geometry", value)
+    }
+    s.field = field
+    s.description = map[string]string{"Path": value, "SHA256": fileSHA256(value)}
+  }
+  s.grid(nil, [3]int{}, 1, head)
+  if verbose {
+    p(fmt.Sprintf("solve the Poisson equation with source %s", value))
+  }
+  return s, nil
+}
+
+// Match the source to the grid of the simulation, the cropped (first voxel offset) and n times
+// upsampled label field with the geometry head.
+func (s *sourceTerm) grid( labels [][][]uint8, offset [3]int, n int, head header ) {
+  h := (head.vz[0] + head.vz[1] + head.vz[2]) / 3
+  if head.goodRASFlag != 1 {
+    h = 1
+  }
+  s.h2 = h*h
+  if s.field == nil || labels == nil {
+    return
+  }
+  lo := offset
+  hi := [3]int{offset[0] + len(labels[0][0])/n - 1, offset[1] + len(labels[0])/n - 1, offset[2] + len(labels)/n - 1}
+  field := s.field
+  if len(field) != len(labels)/n || len(field[0]) != len(labels[0])/n || len(field[0][0]) != len(labels[0][0])/n {
+    field = make([][][]float32, hi[2]-lo[2]+1)
+    for k := range field {
+      field[k] = make([][]float32, hi[1]-lo[1]+1)
+      for j := range field[k] {
+        field[k][j] = make([]float32, hi[0]-lo[0]+1)
+        copy(field[k][j], s.field[lo[2]+k][lo[1]+j][lo[0]:hi[0]+1])
+      }
+    }
+  }
+  if n > 1 {
+    // nearest neighbor like the labels
+    fine := make([][][]float32, len(labels))
+    for k := range fine {
+      fine[k] = make([][]float32, len(labels[0]))
+      for j := range fine[k] {
+        fine[k][j] = make([]float32, len(labels[0][0]))
+        for i := range fine[k][j] {
+          fine[k][j][i] = field[k/n][j/n][i/n]
+        }
+      }
+    }
+    field = fine
+  }
+  s.field = field
+}
+
+// source of voxel (k,j,i) times h^2, the scale of the Laplacian of the stencils
+func (s *sourceTerm) at( k int, j int, i int ) ( float32 ) {
+  if s.field != nil {
+    return s.field[k][j][i] * s.h2
+  }
+  return s.constant * s.h2
+}
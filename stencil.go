@@ -0,0 +1,182 @@
+package main
+
+import (
+  "fmt"
+)
+
+// Laplacian stencils of the simulation, named by the number of neighbors (the 4th order
+// stencil uses the two closest neighbors along each axis)
+var stencilNames = []string{"6", "18", "26", "4th"}
+
+type stencil struct {
+  name string
+  offsets [][3]int  // (dk, dj, di) of the neighbors
+  weights []float32 // weight of each neighbor in the Laplacian
+  center float32    // sum of the weights, the center voxel has weight -center
+  maxStep float32   // largest stable step size of the explicit simulation, 2 over the largest eigenvalue
+}
+
+// The 6 neighbor stencil is the classical 7-point Laplacian, the 18 and 26 neighbor stencils are the
+// isotropic 19-point and 27-point Laplacians (face, edge and corner weights 2:1:0 and 14:3:1) which
+// reduce the axis aligned artifacts of the iso-lines. All are scaled to the Laplacian times h^2.
+func newStencil( name string ) ( stencil, error ) {
+  s := stencil{name: name}
+  var w [4]float32 // by squared distance of the neighbor
+  switch name {
+  case "6", "4th":
+    w = [4]float32{0, 1, 0, 0}
+    s.offsets = neighborOffsets(6)
+    s.maxStep = 1.0/6.0
+    if name == "4th" {
+      s.maxStep = 1.0/8.0 // (30 + 32 + 2)/12 along each axis
+    }
+  case "18":
+    w = [4]float32{0, 2.0/6.0, 1.0/6.0, 0}
+    s.offsets = neighborOffsets(18)
+    s.maxStep = 3.0/8.0
+  case "26":
+    w = [4]float32{0, 14.0/30.0, 3.0/30.0, 1.0/30.0}
+    s.offsets = neighborOffsets(26)
+    s.maxStep = 15.0/46.0
+  default:
+    return s, fmt.Errorf("unknown stencil %s, use one of %v", name, stencilNames)
+  }
+  for _, o := range s.offsets {
+    s.weights = append(s.weights, w[o[0]*o[0]+o[1]*o[1]+o[2]*o[2]])
+    s.center = s.center + s.weights[len(s.weights)-1]
+  }
+  return s, nil
+}
+
+// true if the voxel is inside the volume and not a repulsive boundary voxel
+func available( simThese [][][]uint8, k int, j int, i int ) ( bool ) {
+  if k < 0 || j < 0 || i < 0 || k >= len(simThese) || j >= len(simThese[0]) || i >= len(simThese[0][0]) {
+    return false
+  }
+  return simThese[k][j][i] != maskOther
+}
+
+// Value of the neighbor at offset o for voxel (k,j,i). Neighbors with another label (repulsive
+// boundary) are replaced by the mirrored neighbor, if that is not available either by the center
+// value, so that there is no heat flux across the boundary.
+func neighborValue( f [][][]float32, simThese [][][]uint8, k int, j int, i int, o [3]int ) ( float32 ) {
+  if available(simThese, k+o[0], j+o[1], i+o[2]) {
+    return f[k+o[0]][j+o[1]][i+o[2]]
+  }
+  if available(simThese, k-o[0], j-o[1], i-o[2]) {
+    return f[k-o[0]][j-o[1]][i-o[2]]
+  }
+  return f[k][j][i]
+}
+
+// Laplacian (times h^2) of the field at the simulated voxel (k,j,i). The 4th order stencil
+// (-1 16 -30 16 -1)/12 is used along each axis where all four neighbors are available, the
+// 2nd order stencil otherwise.
+func (s stencil) laplacian( f [][][]float32, simThese [][][]uint8, k int, j int, i int ) ( float32 ) {
+  center := f[k][j][i]
+  if s.name == "4th" {
+    var sum float32
+    for c := 0; c < 3; c++ {
+      var o1, o2 [3]int
+      o1[c] = 1
+      o2[c] = 2
+      if available(simThese, k+o2[0], j+o2[1], i+o2[2]) && available(simThese, k-o2[0], j-o2[1], i-o2[2]) &&
+         available(simThese, k+o1[0], j+o1[1], i+o1[2]) && available(simThese, k-o1[0], j-o1[1], i-o1[2]) {
+        sum = sum + (16*(f[k+o1[0]][j+o1[1]][i+o1[2]] + f[k-o1[0]][j-o1[1]][i-o1[2]]) -
+                     (f[k+o2[0]][j+o2[1]][i+o2[2]] + f[k-o2[0]][j-o2[1]][i-o2[2]]) - 30*center) / 12
+        continue
+      }
+      o2[c] = -1
+      sum = sum + neighborValue(f, simThese, k, j, i, o1) + neighborValue(f, simThese, k, j, i, o2) - 2*center
+    }
+    return sum
+  }
+  var sum float32
+  for n, o := range s.offsets {
+    sum = sum + s.weights[n]*neighborValue(f, simThese, k, j, i, o)
+  }
+  return sum - s.center*center
+}
+
+// Temperature of the simulated voxel (k,j,i) after one explicit step of size omega. The 6 neighbor
+// stencil intentionally keeps the original update of simulate so that its results do not change: a
+// neighbor with another label is replaced by the opposite neighbor (j+1 by i+1) and two such neighbors
+// on one axis contribute their value of 0. The other stencils mirror the neighbors (neighborValue).
+func (s stencil) update( f [][][]float32, simThese [][][]uint8, k int, j int, i int, omega float32 ) ( float32 ) {
+  if s.name != "6" {
+    return f[k][j][i] + omega*s.laplacian(f, simThese, k, j, i)
+  }
+  var val111 = f[ k ][j][i]
+  var val101 = f[k][j-1][i]
+  var val121 = f[k][j+1][i]
+  var val011 = f[k][j][i-1]
+  var val211 = f[k][j][i+1]
+  var val110 = f[k-1][j][i]
+  var val112 = f[k+1][j][i]
+  // repulsive boundary conditions for all other label
+  if simThese[k][j-1][i] == maskOther {
+    val101 = val121
+  }
+  if simThese[k][j+1][i] == maskOther {
+    val121 = val211
+  }
+  if simThese[k][j][i-1] == maskOther {
+    val011 = val211
+  }
+  if simThese[k][j][i+1] == maskOther {
+    val211 = val011
+  }
+  if simThese[k-1][j][i] == maskOther {
+    val110 = val112
+  }
+  if simThese[k+1][j][i] == maskOther {
+    val112 = val110
+  }
+  return float32(1.0-6.0*omega)*val111 + omega*(val101 + val121 + val011 + val211 + val110 + val112)
+}
+
+// Derivative of the field along axis c (0 - i, 1 - j, 2 - k) consistent with the stencil, the weighted
+// central differences of all neighbor pairs along the axis. Only simulated voxel are used, for pairs
+// with one simulated neighbor the one sided difference is used (like difference for the 6 neighbor
+// stencil). The 4th order stencil uses (-1 8 0 -8 1)/12 where the two neighbors on both sides are simulated.
+func (s stencil) derivative( field [][][]float32, simThese [][][]uint8, k int, j int, i int, c int ) ( float32 ) {
+  simulated := func( kk int, jj int, ii int ) ( bool ) {
+    return available(simThese, kk, jj, ii) && simThese[kk][jj][ii] == maskSimulate
+  }
+  axis := 2-c // offsets are (dk, dj, di)
+  if s.name == "4th" {
+    var o1, o2 [3]int
+    o1[axis] = 1
+    o2[axis] = 2
+    if simulated(k+o2[0], j+o2[1], i+o2[2]) && simulated(k-o2[0], j-o2[1], i-o2[2]) &&
+       simulated(k+o1[0], j+o1[1], i+o1[2]) && simulated(k-o1[0], j-o1[1], i-o1[2]) {
+      return (8*(field[k+o1[0]][j+o1[1]][i+o1[2]] - field[k-o1[0]][j-o1[1]][i-o1[2]]) -
+              (field[k+o2[0]][j+o2[1]][i+o2[2]] - field[k-o2[0]][j-o2[1]][i-o2[2]])) / 12
+    }
+    return difference(field, simThese, k, j, i, c, false)
+  }
+  center := field[k][j][i]
+  var num, den float32
+  for n, o := range s.offsets {
+    if o[axis] <= 0 {
+      continue // each pair once
+    }
+    a := center
+    b := center
+    d := float32(0)
+    if simulated(k+o[0], j+o[1], i+o[2]) {
+      a = field[k+o[0]][j+o[1]][i+o[2]]
+      d = d + 1
+    }
+    if simulated(k-o[0], j-o[1], i-o[2]) {
+      b = field[k-o[0]][j-o[1]][i-o[2]]
+      d = d + 1
+    }
+    num = num + s.weights[n]*(a-b)
+    den = den + s.weights[n]*d
+  }
+  if den > 0 {
+    return num/den
+  }
+  return 0
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "math"
+  "math/rand"
+  "bufio"
+  "encoding/binary"
+)
+
+// a streamline as a list of points in voxel coordinates
+type streamline [][3]float32
+
+// voxel to scanner (RAS) coordinates as stored in the mgh header
+func vox2ras( head header ) ( [4][4]float32 ) {
+  vz  := head.vz
+  mdc := head.Mdc
+  c   := head.Pxyz
+  if head.goodRASFlag != 1 {
+    // FreeSurfer's default orientation for volumes without geometry information (coronal)
+    vz  = [3]float32{1, 1, 1}
+    mdc = [9]float32{-1, 0, 0, 0, 0, -1, 0, 1, 0}
+    c   = [3]float32{0, 0, 0}
+  }
+  dims := [3]float32{float32(head.width), float32(head.height), float32(head.depth)}
+  var m [4][4]float32
+  for r := 0; r < 3; r++ {
+    m[r][3] = c[r]
+    for col := 0; col < 3; col++ {
+      m[r][col] = mdc[col*3+r] * vz[col]
+      // the center of the volume (dims/2) maps to Pxyz
+      m[r][3] = m[r][3] - m[r][col]*dims[col]/2.0
+    }
+  }
+  m[3][3] = 1
+  return m
+}
+
+// trilinear interpolation of the interleaved three component gradient field at position pos (voxel coordinates)
+func interpolateGradient( gradient [][][]float32, pos [3]float64 ) ( [3]float64 ) {
+  var g [3]float64
+  var dims [3]int
+  dims[2] = len(gradient)
+  dims[1] = len(gradient[0])
+  dims[0] = len(gradient[0][0])/3
+
+  i0 := int(math.Floor(pos[0]))
+  j0 := int(math.Floor(pos[1]))
+  k0 := int(math.Floor(pos[2]))
+  fi := pos[0] - float64(i0)
+  fj := pos[1] - float64(j0)
+  fk := pos[2] - float64(k0)
+  for dk := 0; dk < 2; dk++ {
+    for dj := 0; dj < 2; dj++ {
+      for di := 0; di < 2; di++ {
+        i := i0 + di
+        j := j0 + dj
+        k := k0 + dk
+        if i < 0 || j < 0 || k < 0 || i >= dims[0] || j >= dims[1] || k >= dims[2] {
+          continue
+        }
+        w := (1-fi)
+        if di == 1 {
+          w = fi
+        }
+        if dj == 1 {
+          w = w * fj
+        } else {
+          w = w * (1-fj)
+        }
+        if dk == 1 {
+          w = w * fk
+        } else {
+          w = w * (1-fk)
+        }
+        for c := 0; c < 3; c++ {
+          g[c] = g[c] + w*float64(gradient[k][j][i*3+c])
+        }
+      }
+    }
+  }
+  return g
+}
+
+// Direction of the streamline at pos as a step per mm in voxel coordinates. The
+// gradient is converted to physical units and normalized so that streamlines
+// advance with constant speed. Returns false if there is no gradient at pos.
+func streamlineDirection( gradient [][][]float32, pos [3]float64, vz [3]float64 ) ( [3]float64, bool ) {
+  g := interpolateGradient(gradient, pos)
+  var l float64
+  for c := 0; c < 3; c++ {
+    g[c] = g[c] / vz[c]
+    l = l + g[c]*g[c]
+  }
+  l = math.Sqrt(l)
+  if l < 1e-12 {
+    return g, false
+  }
+  for c := 0; c < 3; c++ {
+    g[c] = g[c] / l / vz[c]
+  }
+  return g, true
+}
+
+// Integrate streamlines (4th order Runge-Kutta) from the temp0 boundary along the gradient of the
+// temperature field until they reach the temp1 boundary, region is the class of each voxel (see classifyVoxels). Streamlines start in simulated voxel
+// that touch the temp0 boundary, a number of seeds streamlines are started in each of these voxel. Only
+// streamlines that arrive at the temp1 boundary are returned. Step size and maximum length are in mm.
+func traceStreamlines( gradient [][][]float32, region [][][]uint8, head header, seeds int, step float64, maxLength float64, verbose bool ) ( []streamline ) {
+  var dims [3]int
+  dims[2] = len(region)
+  dims[1] = len(region[0])
+  dims[0] = len(region[0][0])
+  vz := [3]float64{1, 1, 1}
+  if head.goodRASFlag == 1 {
+    vz = [3]float64{float64(head.vz[0]), float64(head.vz[1]), float64(head.vz[2])}
+  }
+
+  regionAt := func( pos [3]float64 ) ( uint8 ) {
+    i := int(math.Floor(pos[0]+0.5))
+    j := int(math.Floor(pos[1]+0.5))
+    k := int(math.Floor(pos[2]+0.5))
+    if i < 0 || j < 0 || k < 0 || i >= dims[0] || j >= dims[1] || k >= dims[2] {
+      return maskOther
+    }
+    return region[k][j][i]
+  }
+
+  rnd := rand.New(rand.NewSource(1)) // reproducible seed positions
+  maxSteps := int(maxLength/step)
+  offsets := neighborOffsets(6)
+  var lines []streamline
+  numSeeds := 0
+  for k := 0; k < dims[2]; k++ {
+    for j := 0; j < dims[1]; j++ {
+      for i := 0; i < dims[0]; i++ {
+        if region[k][j][i] != maskSimulate {
+          continue
+        }
+        touches := false
+        for _, o := range offsets {
+          if regionAt([3]float64{float64(i+o[2]), float64(j+o[1]), float64(k+o[0])}) == maskTemp0 {
+            touches = true
+            break
+          }
+        }
+        if !touches {
+          continue
+        }
+        for s := 0; s < seeds; s++ {
+          pos := [3]float64{float64(i), float64(j), float64(k)}
+          if seeds > 1 {
+            for c := 0; c < 3; c++ {
+              pos[c] = pos[c] + rnd.Float64() - 0.5
+            }
+          }
+          numSeeds = numSeeds + 1
+          line := streamline{ {float32(pos[0]), float32(pos[1]), float32(pos[2])} }
+          for t := 0; t < maxSteps; t++ {
+            k1, ok1 := streamlineDirection(gradient, pos, vz)
+            var p2, p3, p4 [3]float64
+            for c := 0; c < 3; c++ {
+              p2[c] = pos[c] + step/2*k1[c]
+            }
+            k2, ok2 := streamlineDirection(gradient, p2, vz)
+            for c := 0; c < 3; c++ {
+              p3[c] = pos[c] + step/2*k2[c]
+            }
+            k3, ok3 := streamlineDirection(gradient, p3, vz)
+            for c := 0; c < 3; c++ {
+              p4[c] = pos[c] + step*k3[c]
+            }
+            k4, ok4 := streamlineDirection(gradient, p4, vz)
+            if !(ok1 && ok2 && ok3 && ok4) {
+              break
+            }
+            for c := 0; c < 3; c++ {
+              pos[c] = pos[c] + step/6*(k1[c] + 2*k2[c] + 2*k3[c] + k4[c])
+            }
+            line = append(line, [3]float32{float32(pos[0]), float32(pos[1]), float32(pos[2])})
+            r := regionAt(pos)
+            if r == maskTemp1 {
+              lines = append(lines, line)
+              break
+            }
+            if r != maskSimulate {
+              break
+            }
+          }
+        }
+      }
+    }
+  }
+  if verbose {
+    p(fmt.Sprintf("%d of %d streamlines reached the temp1 boundary", len(lines), numSeeds))
+  }
+  return lines
+}
+
+// length of a streamline in mm
+func streamlineLength( line streamline, vz [3]float32 ) ( float32 ) {
+  var l float64
+  for n := 1; n < len(line); n++ {
+    var d float64
+    for c := 0; c < 3; c++ {
+      x := float64((line[n][c] - line[n-1][c]) * vz[c])
+      d = d + x*x
+    }
+    l = l + math.Sqrt(d)
+  }
+  return float32(l)
+}
+
+// orientation string of the voxel axes (e.g. LIA for FreeSurfer conformed volumes)
+func voxelOrder( head header ) ( string ) {
+  m := vox2ras(head)
+  pos := []byte{'R', 'A', 'S'}
+  neg := []byte{'L', 'P', 'I'}
+  order := make([]byte, 3)
+  for col := 0; col < 3; col++ {
+    best := 0
+    for r := 1; r < 3; r++ {
+      if math.Abs(float64(m[r][col])) > math.Abs(float64(m[best][col])) {
+        best = r
+      }
+    }
+    if m[best][col] >= 0 {
+      order[col] = pos[best]
+    } else {
+      order[col] = neg[best]
+    }
+  }
+  return string(order)
+}
+
+// save streamlines in TrackVis format, points are stored in voxmm coordinates and
+// the length of each streamline is stored as a property
+func saveTRK( lines []streamline, fn string, head header, verbose bool ) {
+  if verbose {
+    p(fmt.Sprintf("writing file %s...", fn))
+  }
+  fiii, err := os.Create(fn)
+  if err != nil {
+     p(fmt.Sprintf("Error: could not open file %s", fn))
+     os.Exit(-1)
+  }
+  defer fiii.Close()
+  fi := bufio.NewWriter(fiii)
+  defer fi.Flush()
+
+  vz := head.vz
+  if head.goodRASFlag != 1 {
+    vz = [3]float32{1, 1, 1}
+  }
+  m := vox2ras(head)
+
+  hdr := make([]byte, 1000)
+  le := binary.LittleEndian
+  copy(hdr[0:6], "TRACK")
+  le.PutUint16(hdr[6:], uint16(head.width))
+  le.PutUint16(hdr[8:], uint16(head.height))
+  le.PutUint16(hdr[10:], uint16(head.depth))
+  for c := 0; c < 3; c++ {
+    le.PutUint32(hdr[12+4*c:], math.Float32bits(vz[c]))
+  }
+  // origin (24..36) and n_scalars (36) stay zero
+  le.PutUint16(hdr[238:], 1) // n_properties
+  copy(hdr[240:], "length")
+  for r := 0; r < 4; r++ {
+    for col := 0; col < 4; col++ {
+      le.PutUint32(hdr[440+4*(r*4+col):], math.Float32bits(m[r][col]))
+    }
+  }
+  copy(hdr[948:952], voxelOrder(head))
+  le.PutUint32(hdr[988:], uint32(len(lines)))
+  le.PutUint32(hdr[992:], 2)
+  le.PutUint32(hdr[996:], 1000)
+  fi.Write(hdr)
+
+  for _, line := range lines {
+    binary.Write(fi, binary.LittleEndian, int32(len(line)))
+    for _, pt := range line {
+      for c := 0; c < 3; c++ {
+        binary.Write(fi, binary.LittleEndian, (pt[c]+0.5)*vz[c])
+      }
+    }
+    binary.Write(fi, binary.LittleEndian, streamlineLength(line, vz))
+  }
+}
+
+// save streamlines as legacy VTK polydata, points are stored in scanner (RAS) coordinates
+// and the length of each streamline is stored as cell data
+func saveVTK( lines []streamline, fn string, head header, verbose bool ) {
+  if verbose {
+    p(fmt.Sprintf("writing file %s...", fn))
+  }
+  fiii, err := os.Create(fn)
+  if err != nil {
+     p(fmt.Sprintf("Error: could not open file %s", fn))
+     os.Exit(-1)
+  }
+  defer fiii.Close()
+  fi := bufio.NewWriter(fiii)
+  defer fi.Flush()
+
+  vz := head.vz
+  if head.goodRASFlag != 1 {
+    vz = [3]float32{1, 1, 1}
+  }
+  m := vox2ras(head)
+  numPoints := 0
+  for _, line := range lines {
+    numPoints = numPoints + len(line)
+  }
+  fmt.Fprintf(fi, "# vtk DataFile Version 3.0\nheat streamlines\nASCII\nDATASET POLYDATA\n")
+  fmt.Fprintf(fi, "POINTS %d float\n", numPoints)
+  for _, line := range lines {
+    for _, pt := range line {
+      for r := 0; r < 3; r++ {
+        fmt.Fprintf(fi, "%g ", m[r][0]*pt[0] + m[r][1]*pt[1] + m[r][2]*pt[2] + m[r][3])
+      }
+      fmt.Fprintf(fi, "\n")
+    }
+  }
+  fmt.Fprintf(fi, "LINES %d %d\n", len(lines), len(lines) + numPoints)
+  n := 0
+  for _, line := range lines {
+    fmt.Fprintf(fi, "%d", len(line))
+    for range line {
+      fmt.Fprintf(fi, " %d", n)
+      n = n + 1
+    }
+    fmt.Fprintf(fi, "\n")
+  }
+  fmt.Fprintf(fi, "CELL_DATA %d\nSCALARS length float 1\nLOOKUP_TABLE default\n", len(lines))
+  for _, line := range lines {
+    fmt.Fprintf(fi, "%g\n", streamlineLength(line, vz))
+  }
+}
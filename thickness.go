@@ -0,0 +1,165 @@
+package main
+
+import (
+  "fmt"
+  "math"
+)
+
+// a simulated voxel with the upwind weights of the normalized gradient
+type tangentVoxel struct {
+  k, j, i int
+  a [3]float32 // |T_c| / h_c for each axis
+  s [3]int     // sign of T_c for each axis
+  w float32    // length element of the path integral, 1 for distances
+}
+
+// Compute the length of the path along the normalized gradient from the temp0 boundary (L0) and
+// to the temp1 boundary (L1) for each simulated voxel (Yezzi and Prince, 2003). Both are solutions of
+// T . grad(L0) = 1 and -T . grad(L1) = 1 with L0 = 0 at temp0 and L1 = 0 at temp1 voxel, solved
+// by upwind Gauss-Seidel iterations. Distances are in mm (using the voxel size in the header).
+func computeThickness( gradient [][][]float32, mask [][][]uint8, head header, verbose bool ) ( [][][]float32, [][][]float32 ) {
+  var dims [3]int
+  dims[2] = len(mask)
+  dims[1] = len(mask[0])
+  dims[0] = len(mask[0][0])
+
+  l0 := make([][][]float32, dims[2])
+  l1 := make([][][]float32, dims[2])
+  for k := range l0 {
+    l0[k] = make([][]float32, dims[1])
+    l1[k] = make([][]float32, dims[1])
+    for j := range l0[k] {
+      l0[k][j] = make([]float32, dims[0])
+      l1[k][j] = make([]float32, dims[0])
+    }
+  }
+
+  voxels := tangentVoxels(gradient, mask, voxelSize(head))
+  iterations, change := solvePathLength(l0, voxels, mask, -1, maskTemp0)
+  if verbose {
+    p(fmt.Sprintf("L0 computed in %d iterations (last change %g mm)", iterations, change))
+  }
+  iterations, change = solvePathLength(l1, voxels, mask, 1, maskTemp1)
+  if verbose {
+    p(fmt.Sprintf("L1 computed in %d iterations (last change %g mm)", iterations, change))
+  }
+  return l0, l1
+}
+
+// The simulated voxel with a non-zero gradient and the upwind weights of the tangent field T,
+// the gradient in physical units (voxel size vz) normalized to unit length.
+func tangentVoxels( gradient [][][]float32, mask [][][]uint8, vz [3]float32 ) ( []tangentVoxel ) {
+  var dims [3]int
+  dims[2] = len(mask)
+  dims[1] = len(mask[0])
+  dims[0] = len(mask[0][0])
+  var voxels []tangentVoxel
+  for k := 0; k < dims[2]; k++ {
+    for j := 0; j < dims[1]; j++ {
+      for i := 0; i < dims[0]; i++ {
+        if mask[k][j][i] != maskSimulate {
+          continue
+        }
+        var t [3]float64
+        var l float64
+        for c := 0; c < 3; c++ {
+          t[c] = float64(gradient[k][j][i*3+c] / vz[c])
+          l = l + t[c]*t[c]
+        }
+        l = math.Sqrt(l)
+        if l == 0 {
+          continue
+        }
+        v := tangentVoxel{k: k, j: j, i: i, w: 1}
+        for c := 0; c < 3; c++ {
+          v.a[c] = float32(math.Abs(t[c]/l)) / vz[c]
+          if t[c] > 0 {
+            v.s[c] = 1
+          } else if t[c] < 0 {
+            v.s[c] = -1
+          }
+        }
+        voxels = append(voxels, v)
+      }
+    }
+  }
+  return voxels
+}
+
+// thickness L0+L1 and the normalized depth L0/(L0+L1)
+func thicknessAndDepth( l0 [][][]float32, l1 [][][]float32 ) ( [][][]float32, [][][]float32 ) {
+  thickness := make([][][]float32, len(l0))
+  depth := make([][][]float32, len(l0))
+  for k := range l0 {
+    thickness[k] = make([][]float32, len(l0[k]))
+    depth[k] = make([][]float32, len(l0[k]))
+    for j := range l0[k] {
+      thickness[k][j] = make([]float32, len(l0[k][j]))
+      depth[k][j] = make([]float32, len(l0[k][j]))
+      for i := range l0[k][j] {
+        thickness[k][j][i] = l0[k][j][i] + l1[k][j][i]
+        if thickness[k][j][i] > 0 {
+          depth[k][j][i] = l0[k][j][i] / thickness[k][j][i]
+        }
+      }
+    }
+  }
+  return thickness, depth
+}
+
+// Gauss-Seidel iterations for the path length L, each voxel is updated from its upwind
+// neighbors (dir = -1 for L0 and +1 for L1), voxel of class zero have a distance of zero.
+// The path length is the integral of the weight w of the voxel along the path.
+// Returns the number of iterations and the largest change in the last iteration.
+func solvePathLength( L [][][]float32, voxels []tangentVoxel, mask [][][]uint8, dir int, zero uint8 ) ( int, float32 ) {
+  var dims [3]int
+  dims[2] = len(mask)
+  dims[1] = len(mask[0])
+  dims[0] = len(mask[0][0])
+
+  maxIterations := 1000
+  tolerance := float32(1e-4)
+  iter := 0
+  change := float32(0)
+  for ; iter < maxIterations; iter++ {
+    change = 0
+    for n := range voxels {
+      // alternate the sweep direction to propagate information in both directions
+      v := voxels[n]
+      if iter % 2 == 1 {
+        v = voxels[len(voxels)-1-n]
+      }
+      num := v.w
+      den := float32(0)
+      for c := 0; c < 3; c++ {
+        if v.s[c] == 0 {
+          continue
+        }
+        nb := [3]int{v.i, v.j, v.k}
+        nb[c] = nb[c] + dir*v.s[c]
+        if nb[0] < 0 || nb[1] < 0 || nb[2] < 0 || nb[0] >= dims[0] || nb[1] >= dims[1] || nb[2] >= dims[2] {
+          continue
+        }
+        m := mask[nb[2]][nb[1]][nb[0]]
+        if m == maskSimulate {
+          num = num + v.a[c]*L[nb[2]][nb[1]][nb[0]]
+        } else if m != zero {
+          continue // repulsive boundary or the other temperature, no information from here
+        }
+        den = den + v.a[c]
+      }
+      if den == 0 {
+        continue
+      }
+      val := num / den
+      if d := float32(math.Abs(float64(val - L[v.k][v.j][v.i]))); d > change {
+        change = d
+      }
+      L[v.k][v.j][v.i] = val
+    }
+    if change < tolerance {
+      break
+    }
+  }
+  return iter, change
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+  "fmt"
+  "path"
+  "strings"
+)
+
+// Volumes without geometry get the default orientation (see vox2ras) so that derived grids
+// (cropped or upsampled) stay aligned with them.
+func explicitGeometry( head header ) ( header ) {
+  if head.goodRASFlag != 1 {
+    head.vz = [3]float32{1, 1, 1}
+    head.Mdc = [9]float32{-1, 0, 0, 0, 0, -1, 0, 1, 0}
+    head.Pxyz = [3]float32{0, 0, 0}
+    head.goodRASFlag = 1
+  }
+  return head
+}
+
+// Geometry of a grid with n times smaller voxel covering the same field of view. The centers of the
+// fine voxel of voxel 0 are at -0.5 + 0.5/n (coarse voxel coordinates), Pxyz (the RAS of the center
+// of the volume at dims/2) moves by Mdc vz (0.5/n - 0.5).
+func upsampleHeader( head header, n int ) ( header ) {
+  fine := explicitGeometry(head)
+  fine.width = head.width * int32(n)
+  fine.height = head.height * int32(n)
+  fine.depth = head.depth * int32(n)
+  shift := 0.5/float32(n) - 0.5
+  for r := 0; r < 3; r++ {
+    for c := 0; c < 3; c++ {
+      fine.Pxyz[r] = fine.Pxyz[r] + fine.Mdc[c*3+r]*fine.vz[c]*shift
+    }
+  }
+  for c := 0; c < 3; c++ {
+    fine.vz[c] = fine.vz[c] / float32(n)
+  }
+  return fine
+}
+
+// nearest neighbor upsampling of the label field, each voxel becomes a block of n^3 voxel
+func upsampleLabels( labels [][][]uint8, n int ) ( [][][]uint8 ) {
+  fine := make([][][]uint8, len(labels)*n)
+  for k := range fine {
+    fine[k] = make([][]uint8, len(labels[0])*n)
+    for j := range fine[k] {
+      fine[k][j] = make([]uint8, len(labels[0][0])*n)
+      for i := range fine[k][j] {
+        fine[k][j][i] = labels[k/n][j/n][i/n]
+      }
+    }
+  }
+  return fine
+}
+
+// Mean of each block of n^3 voxel for fields with the given number of interleaved frames. All voxel
+// of a block have the same label (see upsampleLabels) so that the mean does not mix classes.
+func downsampleField( field [][][]float32, n int, frames int ) ( [][][]float32 ) {
+  coarse := make([][][]float32, len(field)/n)
+  w := float32(n*n*n)
+  for k := range coarse {
+    coarse[k] = make([][]float32, len(field[0])/n)
+    for j := range coarse[k] {
+      coarse[k][j] = make([]float32, len(field[0][0])/n)
+      for i := 0; i < len(coarse[k][j])/frames; i++ {
+        for f := 0; f < frames; f++ {
+          var sum float32
+          for kk := k*n; kk < (k+1)*n; kk++ {
+            for jj := j*n; jj < (j+1)*n; jj++ {
+              for ii := i*n; ii < (i+1)*n; ii++ {
+                sum = sum + field[kk][jj][ii*frames+f]
+              }
+            }
+          }
+          coarse[k][j][i*frames+f] = sum / w
+        }
+      }
+    }
+  }
+  return coarse
+}
+
+// most frequent value in each block of n^3 voxel (shell labels)
+func downsampleLabels( field [][][]uint8, n int ) ( [][][]uint8 ) {
+  coarse := make([][][]uint8, len(field)/n)
+  var counts [256]int
+  for k := range coarse {
+    coarse[k] = make([][]uint8, len(field[0])/n)
+    for j := range coarse[k] {
+      coarse[k][j] = make([]uint8, len(field[0][0])/n)
+      for i := range coarse[k][j] {
+        counts = [256]int{}
+        best := uint8(0)
+        for kk := k*n; kk < (k+1)*n; kk++ {
+          for jj := j*n; jj < (j+1)*n; jj++ {
+            for ii := i*n; ii < (i+1)*n; ii++ {
+              v := field[kk][jj][ii]
+              counts[v] = counts[v] + 1
+              if counts[v] > counts[best] || (counts[v] == counts[best] && v < best) {
+                best = v
+              }
+            }
+          }
+        }
+        coarse[k][j][i] = best
+      }
+    }
+  }
+  return coarse
+}
+
+// name of an output at the upsampled resolution, <name>_up<N>.mgz or with the res entity for
+// BIDS names (..._res-up<N>_desc-...)
+func upsampledName( fn string, n int ) ( string ) {
+  d, f := path.Split(fn)
+  if i := strings.Index(f, "_desc-"); i >= 0 {
+    return path.Join(d, f[0:i] + fmt.Sprintf("_res-up%d", n) + f[i:])
+  }
+  base := stripExtension(f)
+  return path.Join(d, base + fmt.Sprintf("_up%d", n) + f[len(base):])
+}
+
+// The grids of a simulation on a cropped (--crop-margin) and upsampled (--upsample) label field.
+// Outputs are pasted back into the full volume and written at the resolution of the simulation (fine)
+// and downsampled to the grid of the input (coarse), without upsampling (n = 1) only the input grid
+// is written.
+type resolutions struct {
+  n int
+  fine, coarse header // full volumes of the outputs
+  offset [3]int       // first voxel (i, j, k) of the cropped volume in the coarse grid
+  verbose bool
+}
+
+func newResolutions( head header, n int, verbose bool ) ( resolutions ) {
+  r := resolutions{n: n, fine: head, coarse: head, verbose: verbose}
+  if n > 1 {
+    r.fine = upsampleHeader(head, n)
+  }
+  return r
+}
+
+// Crop the label field to the bounding box of the labels in lists plus margin voxel, returns
+// the cropped field and its geometry. The field is not changed if none of the labels exists.
+func (r *resolutions) crop( labels [][][]uint8, margin int, lists ...[]int ) ( [][][]uint8, header ) {
+  lo, hi, ok := boundingBox(labels, margin, lists...)
+  if !ok {
+    return labels, r.coarse
+  }
+  r.offset = lo
+  if r.verbose {
+    p(fmt.Sprintf("crop the label field to voxel %v..%v", lo, hi))
+  }
+  return cropLabels(labels, lo, hi), cropHeader(r.coarse, lo, hi)
+}
+
+// offset of the cropped volume in the fine grid
+func (r resolutions) fineOffset() ( [3]int ) {
+  return [3]int{r.offset[0]*r.n, r.offset[1]*r.n, r.offset[2]*r.n}
+}
+
+// file names of an output at all resolutions
+func (r resolutions) names( fn string ) ( []string ) {
+  if r.n > 1 {
+    return []string{fn, upsampledName(fn, r.n)}
+  }
+  return []string{fn}
+}
+
+func (r resolutions) saveMGH( field [][][]float32, fn string ) {
+  if r.n == 1 {
+    saveMGH(pasteField(field, r.coarse, r.offset, 1), fn, r.coarse, r.verbose)
+    return
+  }
+  saveMGH(pasteField(field, r.fine, r.fineOffset(), 1), upsampledName(fn, r.n), r.fine, r.verbose)
+  saveMGH(pasteField(downsampleField(field, r.n, 1), r.coarse, r.offset, 1), fn, r.coarse, r.verbose)
+}
+
+// Three frame fields, the gradient is in voxel units and gets n times larger on the coarse
+// grid, unit length directions are normalized again after averaging.
+func (r resolutions) saveMGHgradient( gradient [][][]float32, fn string, unit bool ) {
+  if r.n == 1 {
+    saveMGHgradient(pasteField(gradient, r.coarse, r.offset, 3), fn, r.coarse, r.verbose)
+    return
+  }
+  saveMGHgradient(pasteField(gradient, r.fine, r.fineOffset(), 3), upsampledName(fn, r.n), r.fine, r.verbose)
+  coarse := downsampleField(gradient, r.n, 3)
+  if unit {
+    coarse, _ = normalizeGradient(coarse, header{})
+  } else {
+    for k := range coarse {
+      for j := range coarse[k] {
+        for i := range coarse[k][j] {
+          coarse[k][j][i] = coarse[k][j][i] * float32(r.n)
+        }
+      }
+    }
+  }
+  saveMGHgradient(pasteField(coarse, r.coarse, r.offset, 3), fn, r.coarse, r.verbose)
+}
+
+func (r resolutions) saveMGHuint8( field [][][]uint8, fn string ) {
+  if r.n == 1 {
+    saveMGHuint8(pasteLabels(field, r.coarse, r.offset), fn, r.coarse, r.verbose)
+    return
+  }
+  saveMGHuint8(pasteLabels(field, r.fine, r.fineOffset()), upsampledName(fn, r.n), r.fine, r.verbose)
+  saveMGHuint8(pasteLabels(downsampleLabels(field, r.n), r.coarse, r.offset), fn, r.coarse, r.verbose)
+}
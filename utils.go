@@ -29,6 +29,12 @@ type header  struct {
   Pxyz [3]float32
 }
 
+// temperatures assigned to the --temp0 and --temp1 boundaries (--temp0-value and --temp1-value)
+var (
+  lowTemperature  float32 = 0.01
+  highTemperature float32 = 0.1
+)
+
 func readUCHAR8(file *os.File, s int64) ([]byte,int64) {
   buf := make([]byte, s)
   ntotal := int64(0)
@@ -99,8 +105,9 @@ func readFLOAT(file *os.File, s int64) ([]byte,int64) {
 }
 
 
-// read in mgz file - ignores all transformations
-func readMGH( fn string, verbose bool ) ( [][][]uint8, header ) {
+// open an mgh/mgz file and read its header, the returned file is positioned
+// at the start of the voxel data (byte 284)
+func openMGH( fn string, verbose bool ) ( *os.File, header ) {
 
   var head header
   // find out if the file has mgz extension (read with zip file reader first)
@@ -110,26 +117,35 @@ func readMGH( fn string, verbose bool ) ( [][][]uint8, header ) {
 
      fi, err := os.Open(fn)
      if err != nil {
-       p(fmt.Sprintf("Error: could not open file"))
+       p(fmt.Sprintf("Error: could not open file %s", fn))
        os.Exit(-1)
      }
      defer fi.Close()
      fz, err := gzip.NewReader(fi)
      if err != nil {
+       p(fmt.Sprintf("Error: could not uncompress file %s", fn))
        os.Exit(-1)
      }
      defer fz.Close()
      s, err := ioutil.ReadAll(fz)
      if err != nil {
+       p(fmt.Sprintf("Error: could not uncompress file %s", fn))
        os.Exit(-1)
      }
-     newfn := ".download.mgh"
-
-     err = ioutil.WriteFile(newfn, s, 0644)
+     // use a unique temporary file, several instances may run in the same directory (see batch)
+     tmp, err := ioutil.TempFile("", "heat-*.mgh")
      if err != nil {
         p(fmt.Sprintf("Error: could not write temporary file"))
+        os.Exit(-1)
      }
-     fn = newfn
+     defer os.Remove(tmp.Name())
+     _, err = tmp.Write(s)
+     tmp.Close()
+     if err != nil {
+        p(fmt.Sprintf("Error: could not write temporary file"))
+        os.Exit(-1)
+     }
+     fn = tmp.Name()
   }
 
   var file *os.File
@@ -142,7 +158,11 @@ func readMGH( fn string, verbose bool ) ( [][][]uint8, header ) {
     if verbose {
       p("try to download file")
     }
-    out, _ := os.Create(".download")
+    out, err := ioutil.TempFile("", "heat-download-*")
+    if err != nil {
+      log.Fatal(err)
+    }
+    defer os.Remove(out.Name())
     defer out.Close()
     resp, err := http.Get(fn)
     if err != nil {
@@ -153,12 +173,11 @@ func readMGH( fn string, verbose bool ) ( [][][]uint8, header ) {
     if err != nil {
        log.Fatal(err)
     }
-    file, err = os.Open(".download")
+    file, err = os.Open(out.Name())
     if err != nil {
       log.Fatal(err)
     }
   }
-  defer file.Close()
 
   // now start reading the file (un-gzipped mgh)
   head.version = read4(file)
@@ -183,6 +202,51 @@ func readMGH( fn string, verbose bool ) ( [][][]uint8, header ) {
   if head.nframes != 1 {
     p(fmt.Sprintf("Warning: only the first frame will be read"))    
   }
+
+  if head.goodRASFlag == 1 {
+    // read and forget the
+    head.vz[0] = read4AsFloat(file)  
+    head.vz[1] = read4AsFloat(file)  
+    head.vz[2] = read4AsFloat(file)
+    head.Mdc[0] = read4AsFloat(file)
+    head.Mdc[1] = read4AsFloat(file)
+    head.Mdc[2] = read4AsFloat(file)
+    head.Mdc[3] = read4AsFloat(file)
+    head.Mdc[4] = read4AsFloat(file)
+    head.Mdc[5] = read4AsFloat(file)
+    head.Mdc[6] = read4AsFloat(file)
+    head.Mdc[7] = read4AsFloat(file)
+    head.Mdc[8] = read4AsFloat(file)
+    head.Pxyz[0] = read4AsFloat(file)
+    head.Pxyz[1] = read4AsFloat(file)
+    head.Pxyz[2] = read4AsFloat(file)
+  }
+  
+  file.Seek(284, 0)
+  return file, head
+}
+
+// read in mgz (or nifti) file - ignores all transformations
+func readMGH( fn string, verbose bool ) ( [][][]uint8, header ) {
+
+  if isNIfTI(fn) {
+    // label fields stored as nifti are rounded to unsigned char as well
+    field, head := readNIfTIfloat(fn, verbose)
+    labels := make([][][]uint8, len(field))
+    for k := range field {
+      labels[k] = make([][]uint8, len(field[k]))
+      for j := range field[k] {
+        labels[k][j] = make([]uint8, len(field[k][j]))
+        for i := range field[k][j] {
+          labels[k][j][i] = uint8(math.Floor(float64(field[k][j][i])+0.5))
+        }
+      }
+    }
+    return labels, head
+  }
+
+  file, head := openMGH(fn, verbose)
+  defer file.Close()
   
   if head.t != 0 && head.t != 3 {
     p(fmt.Sprintf("Error: could not find unsigned char field (0) but found %d", head.t))
@@ -205,26 +269,6 @@ func readMGH( fn string, verbose bool ) ( [][][]uint8, header ) {
     }
   }
 
-  if head.goodRASFlag == 1 {
-    // read and forget the
-    head.vz[0] = read4AsFloat(file)  
-    head.vz[1] = read4AsFloat(file)  
-    head.vz[2] = read4AsFloat(file)
-    head.Mdc[0] = read4AsFloat(file)
-    head.Mdc[1] = read4AsFloat(file)
-    head.Mdc[2] = read4AsFloat(file)
-    head.Mdc[3] = read4AsFloat(file)
-    head.Mdc[4] = read4AsFloat(file)
-    head.Mdc[5] = read4AsFloat(file)
-    head.Mdc[6] = read4AsFloat(file)
-    head.Mdc[7] = read4AsFloat(file)
-    head.Mdc[8] = read4AsFloat(file)
-    head.Pxyz[0] = read4AsFloat(file)
-    head.Pxyz[1] = read4AsFloat(file)
-    head.Pxyz[2] = read4AsFloat(file)
-  }
-  
-  file.Seek(284, 0)
   // now read in the data (don't need to swap because its all unsigned char)
   var buf []byte
   var ntotal int64
@@ -253,6 +297,67 @@ func readMGH( fn string, verbose bool ) ( [][][]uint8, header ) {
   return labels, head
 }
 
+// read the first frame of an mgz (or nifti) file as floating point values, unsigned char
+// volumes (label fields) are converted so both can be used as input
+func readMGHfloat( fn string, verbose bool ) ( [][][]float32, header ) {
+
+  if isNIfTI(fn) {
+    return readNIfTIfloat(fn, verbose)
+  }
+
+  file, head := openMGH(fn, verbose)
+  defer file.Close()
+
+  var dims [3]int
+  dims[0] = int(head.width)
+  dims[1] = int(head.height)
+  dims[2] = int(head.depth)
+  field := make([][][]float32, dims[2])
+  for i := range field {
+    field[i] = make([][]float32, dims[1])
+    for j := range field[i] {
+      field[i][j] = make([]float32, dims[0])
+    }
+  }
+
+  r := bufio.NewReader(file)
+  for k := 0; k < dims[2]; k++ {
+    for j := 0; j < dims[1]; j++ {
+      var err error
+      if head.t == 3 {
+        err = binary.Read(r, binary.BigEndian, field[k][j])
+      } else {
+        row := make([]uint8, dims[0])
+        _, err = io.ReadFull(r, row)
+        for i := range row {
+          field[k][j][i] = float32(row[i])
+        }
+      }
+      if err != nil {
+        p(fmt.Sprintf("Error: could not read all data from file %s", fn))
+        os.Exit(-1)
+      }
+    }
+  }
+
+  return field, head
+}
+
+// true if the list contains the string
+func contains( list []string, s string ) ( bool ) {
+  for _, l := range list {
+    if l == s {
+      return true
+    }
+  }
+  return false
+}
+
+// true if both volumes share the same voxel grid
+func sameDimensions( a header, b header ) ( bool ) {
+  return a.width == b.width && a.height == b.height && a.depth == b.depth
+}
+
 func read4AsFloat( file *os.File ) (float32) {
   
   buf4 := make([]byte, 4)  
@@ -340,28 +445,45 @@ func read2( file *os.File ) (int16) {
   return val
 }
 
-func saveMGH( field [][][]float32, fn string, head header, verbose bool) {
+// Create an output volume, nifti (.nii, .nii.gz) or mgh (gzip compressed for .mgz) depending
+// on the file name. Writes the header for data of type typ (0 - unsigned char, 3 - float) and
+// returns a writer for the voxel data, the byte order of the format and a function that has
+// to be called after all data has been written.
+func createVolume( fn string, head header, typ int32, nframes int32, verbose bool ) ( *bufio.Writer, binary.ByteOrder, func() ) {
   if verbose {
     p(fmt.Sprintf("writing file %s...", fn))
   }
-  // write the input field to fn, we can take the header from the parent, but we need to change the output type to float (3)
   fiii, err := os.Create(fn)
   if err != nil {
      p(fmt.Sprintf("Error: could not open file %s", fn))
      os.Exit(-1)
   }
-  defer fiii.Close()
-  fii := gzip.NewWriter(fiii)
-  fi := bufio.NewWriter(fii)
-  defer fii.Close()
-  
-  var typ int32
-  typ = 3 // save as floating point field
+  var fi *bufio.Writer
+  var fii *gzip.Writer
+  if path.Ext(fn) == ".mgh" || path.Ext(fn) == ".nii" {
+    fi = bufio.NewWriter(fiii)
+  } else {
+    fii = gzip.NewWriter(fiii)
+    fi = bufio.NewWriter(fii)
+  }
+  done := func() {
+    fi.Flush()
+    if fii != nil {
+      fii.Close()
+    }
+    fiii.Close()
+  }
+
+  if isNIfTI(fn) {
+    fi.Write(niftiHeader(head, typ, nframes))
+    return fi, binary.LittleEndian, done
+  }
+
   save4(fi, head.version)
   save4(fi, head.width)
   save4(fi, head.height)
   save4(fi, head.depth)
-  save4(fi, head.nframes)
+  save4(fi, nframes)
   save4(fi, typ)
   save4(fi, head.dof)
   save2(fi, head.goodRASFlag)
@@ -382,7 +504,7 @@ func saveMGH( field [][][]float32, fn string, head header, verbose bool) {
   save4float32(fi, head.Pxyz[1])
   save4float32(fi, head.Pxyz[2])
   
-  // go to byte 284 (did write 82 bytes so far)
+  // go to byte 284 (did write 90 bytes so far)
   for i := 0; i < (284-90); i++ {
     var val uint8
     val = 0
@@ -391,136 +513,58 @@ func saveMGH( field [][][]float32, fn string, head header, verbose bool) {
        p(fmt.Sprintf("Error: could not write bytes to output"))
     }
   }
+  return fi, binary.BigEndian, done
+}
+
+func saveMGH( field [][][]float32, fn string, head header, verbose bool) {
+  // write the input field to fn, we can take the header from the parent, but we need to change the output type to float (3)
+  fi, order, done := createVolume(fn, head, 3, 1, verbose)
+  defer done()
+
   // now save the binary data
   for k := 0; k < int(head.depth); k++ {
     for j := 0; j < int(head.height); j++ {
-        err := binary.Write(fi, binary.BigEndian, field[k][j][:])
+        err := binary.Write(fi, order, field[k][j][:])
         if err != nil {
            p(fmt.Sprintf("Error: could not write bytes to output"))          
         }
     }
   }
-  fi.Flush()
 }
 
 func saveMGHgradient(gradient [][][]float32, fn string, head header, verbose bool) {
-  if verbose {
-    p(fmt.Sprintf("writing file %s...", fn))
-  }
   // write the input field to fn, we can take the header from the parent, but we need to change the output type to float (3)
-  fiii, err := os.Create(fn)
-  if err != nil {
-     p(fmt.Sprintf("Error: could not open file %s", fn))
-     os.Exit(-1)
-  }
-  defer fiii.Close()
-  fii := gzip.NewWriter(fiii)
-  fi := bufio.NewWriter(fii)
-  defer fii.Close()
-  
-  var typ int32
-  typ = 3 // save as floating point field
-  head.nframes = 3
-  save4(fi, head.version)
-  save4(fi, head.width)
-  save4(fi, head.height)
-  save4(fi, head.depth)
-  save4(fi, head.nframes)
-  save4(fi, typ)
-  save4(fi, head.dof)
-  save2(fi, head.goodRASFlag)
+  fi, order, done := createVolume(fn, head, 3, 3, verbose)
+  defer done()
   
-  save4float32(fi, head.vz[0])
-  save4float32(fi, head.vz[1])
-  save4float32(fi, head.vz[2])
-  save4float32(fi, head.Mdc[0])
-  save4float32(fi, head.Mdc[1])
-  save4float32(fi, head.Mdc[2])
-  save4float32(fi, head.Mdc[3])
-  save4float32(fi, head.Mdc[4])
-  save4float32(fi, head.Mdc[5])
-  save4float32(fi, head.Mdc[6])
-  save4float32(fi, head.Mdc[7])
-  save4float32(fi, head.Mdc[8])  
-  save4float32(fi, head.Pxyz[0])
-  save4float32(fi, head.Pxyz[1])
-  save4float32(fi, head.Pxyz[2])
-  
-  // go to byte 284 (did write 82 bytes so far)
-  for i := 0; i < (284-90); i++ {
-    var val uint8
-    val = 0
-    err := binary.Write(fi, binary.BigEndian, val)
-    if err != nil {
-       p(fmt.Sprintf("Error: could not write bytes to output"))
-    }
-  }
-  
-  // for mgz we need to save each frame individually
-  var dims [3]int
-  dims[2] = len(gradient)
-  dims[1] = len(gradient[0])
-  dims[0] = len(gradient[0][0])/3 // three components per voxel
-  // get the memory for a single component
-  gf := make([][][]float32, dims[2])
-  for i := range gf {
-    gf[i] = make([][]float32, dims[1])
-    for j := range gf[i] {
-      gf[i][j] = make([]float32, dims[0])
-    }
-  }
-
-  // copy first component into gf and save, repeat with the other components  
-  for k := range gf {
-    for j := range gf[k] {
-      for i := range gf[k][j] {
-        gf[k][j][i] = gradient[k][j][i*3+0]
-      }
-    }
-  }
-  
-  // now save the binary data
-  for k := range gf {
-    for j := range gf[k] {
-        err := binary.Write(fi, binary.BigEndian, gf[k][j][:])
-        if err != nil {
-           p(fmt.Sprintf("Error: could not write bytes to output"))          
+  // for mgz we need to save each frame individually, write one component
+  // at a time row by row instead of copying the frame
+  row := make([]float32, head.width)
+  for c := 0; c < 3; c++ {
+    for k := range gradient {
+      for j := range gradient[k] {
+        for i := range row {
+          row[i] = gradient[k][j][i*3+c]
         }
-    }
-  }
-  
-  // copy second component into gf and save, repeat with the other components  
-  for k := range gf {
-    for j := range gf[k] {
-      for i := range gf[k][j] {
-        gf[k][j][i] = gradient[k][j][i*3+1]
-      }
-    }
-  }
-  
-  // now save the binary data
-  for k := range gf {
-    for j := range gf[k] {
-        err := binary.Write(fi, binary.BigEndian, gf[k][j][:])
+        err := binary.Write(fi, order, row)
         if err != nil {
            p(fmt.Sprintf("Error: could not write bytes to output"))          
         }
-    }
-  }
-
-  // copy third component into gf and save, repeat with the other components  
-  for k := range gf {
-    for j := range gf[k] {
-      for i := range gf[k][j] {
-        gf[k][j][i] = gradient[k][j][i*3+2]
       }
     }
   }
-  
+}
+
+
+func saveMGHuint8( field [][][]uint8, fn string, head header, verbose bool) {
+  // write the input field to fn, we can take the header from the parent, but we need to change the output type to unsigned char (0)
+  fi, order, done := createVolume(fn, head, 0, 1, verbose)
+  defer done()
+
   // now save the binary data
-  for k := range gf {
-    for j := range gf[k] {
-        err := binary.Write(fi, binary.BigEndian, gf[k][j][:])
+  for k := 0; k < int(head.depth); k++ {
+    for j := 0; j < int(head.height); j++ {
+        err := binary.Write(fi, order, field[k][j][:])
         if err != nil {
            p(fmt.Sprintf("Error: could not write bytes to output"))          
         }
@@ -528,77 +572,57 @@ func saveMGHgradient(gradient [][][]float32, fn string, head header, verbose boo
   }
 }
 
+// differencing schemes for the gradient of the temperature field
+var gradientSchemes = []string{"central", "sobel", "upwind"}
 
-func saveMGHuint8( field [][][]uint8, fn string, head header, verbose bool) {
-  if verbose {
-    p(fmt.Sprintf("writing file %s...", fn))
+// Difference of the field along axis c (0 - i, 1 - j, 2 - k) at voxel (k,j,i). Only
+// simulated voxel are used, at the border of the simulated region the one sided
+// difference is used. The upwind scheme uses the one sided difference towards the
+// colder neighbor (the direction streamlines are coming from).
+func difference( field [][][]float32, simThese [][][]uint8, k int, j int, i int, c int, upwind bool ) ( float32 ) {
+  var o [3]int
+  o[2-c] = 1
+  simulated := func( kk int, jj int, ii int ) ( bool ) {
+    if kk < 0 || jj < 0 || ii < 0 || kk >= len(simThese) || jj >= len(simThese[0]) || ii >= len(simThese[0][0]) {
+      return false
+    }
+    return simThese[kk][jj][ii] == maskSimulate
   }
-  // write the input field to fn, we can take the header from the parent, but we need to change the output type to float (3)
-  fiii, err := os.Create(fn)
-  if err != nil {
-     p(fmt.Sprintf("Error: could not open file %s", fn))
-     os.Exit(-1)
+  center := field[k][j][i]
+  a := center
+  b := center
+  d := 2
+  if simulated(k+o[0], j+o[1], i+o[2]) {
+    a = field[k+o[0]][j+o[1]][i+o[2]]
+  } else {
+    d = d - 1
   }
-  defer fiii.Close()
-  fii := gzip.NewWriter(fiii)
-  fi := bufio.NewWriter(fii)
-  defer fii.Close()
-  
-  var typ int32
-  typ = 0 // save as floating point field
-  save4(fi, head.version)
-  save4(fi, head.width)
-  save4(fi, head.height)
-  save4(fi, head.depth)
-  save4(fi, head.nframes)
-  save4(fi, typ)
-  save4(fi, head.dof)
-  save2(fi, head.goodRASFlag)
-  
-  save4float32(fi, head.vz[0])
-  save4float32(fi, head.vz[1])
-  save4float32(fi, head.vz[2])
-  save4float32(fi, head.Mdc[0])
-  save4float32(fi, head.Mdc[1])
-  save4float32(fi, head.Mdc[2])
-  save4float32(fi, head.Mdc[3])
-  save4float32(fi, head.Mdc[4])
-  save4float32(fi, head.Mdc[5])
-  save4float32(fi, head.Mdc[6])
-  save4float32(fi, head.Mdc[7])
-  save4float32(fi, head.Mdc[8])  
-  save4float32(fi, head.Pxyz[0])
-  save4float32(fi, head.Pxyz[1])
-  save4float32(fi, head.Pxyz[2])
-  
-  // go to byte 284 (did write 82 bytes so far)
-  for i := 0; i < (284-90); i++ {
-    var val uint8
-    val = 0
-    err := binary.Write(fi, binary.BigEndian, val)
-    if err != nil {
-       p(fmt.Sprintf("Error: could not write bytes to output"))
-    }
+  if simulated(k-o[0], j-o[1], i-o[2]) {
+    b = field[k-o[0]][j-o[1]][i-o[2]]
+  } else {
+    d = d - 1
   }
-  // now save the binary data
-  for k := 0; k < int(head.depth); k++ {
-    for j := 0; j < int(head.height); j++ {
-        err := binary.Write(fi, binary.BigEndian, field[k][j][:])
-        if err != nil {
-           p(fmt.Sprintf("Error: could not write bytes to output"))          
-        }
+  if upwind && d == 2 {
+    if b < a {
+      return center - b
     }
+    return a - center
+  }
+  if d > 0 {
+    return (a-b)/float32(d)
   }
-  //fi.Sync()
+  return 0 // else should be zero
 }
 
-// three components for each voxel
-func computeGradientField(field [][][]float32, labels [][][]uint8, simulate []int) ([][][]float32) {
+// three components for each voxel, simThese is the class of each voxel as used by simulate
+// (see classifyVoxels), the gradient is computed for all simulated voxel. Stencils other than
+// the 6 neighbor stencil use their own differences (see stencil.derivative) instead of the scheme.
+func computeGradientField(field [][][]float32, simThese [][][]uint8, scheme string, st stencil) ([][][]float32) {
 
   var dims [3]int
-  dims[2] = len(labels)
-  dims[1] = len(labels[0])
-  dims[0] = len(labels[0][0]) // three components per voxel
+  dims[2] = len(simThese)
+  dims[1] = len(simThese[0])
+  dims[0] = len(simThese[0][0]) // three components per voxel
   // get the memory
   gf := make([][][]float32, dims[2])
   for i := range gf {
@@ -608,79 +632,42 @@ func computeGradientField(field [][][]float32, labels [][][]uint8, simulate []in
     }
   }
 
-  simThese := make([][][]uint8, dims[2])
-  for k := range simThese {
-     simThese[k] = make([][]uint8, dims[1])
-     for j := range simThese[k] {
-       simThese[k][j] = make([]uint8, dims[0])
-       for i := range simThese[k][j] {
-          simThese[k][j][i] = 0
-          val := int(labels[k][j][i])
-          for l := range simulate {
-             if simulate[l] == val {
-                simThese[k][j][i] = 1 // only export distance for these voxel
-                break
-             }
-          }
-       }
-     }
-  }
-  
-  for k := 1; k < dims[2]-1; k++ {
-    for j := 1; j < dims[1]-1; j++ {
-      var a float32
-      var b float32
-      var d int
-      for i := 1; i < dims[0]-1; i++ {
-        if simThese[k][j][i] != 1 {
+  upwind := scheme == "upwind"
+  for k := 0; k < dims[2]; k++ {
+    for j := 0; j < dims[1]; j++ {
+      for i := 0; i < dims[0]; i++ {
+        if simThese[k][j][i] != maskSimulate {
           continue
         }
-        // if we are at the border of a material we have to
-        // use the one sided gradient
-        a = field[k][j][i+1]
-        b = field[k][j][i-1]
-        d = 2
-        if simThese[k][j][i+1] == 0 {
-          a = field[k][j][i]
-          d = d - 1
-        }
-        if simThese[k][j][i-1] == 0 {
-          b = field[k][j][i]
-          d = d - 1
-        }
-        if d > 0 {
-          gf[k][j][i*3+0] = (a-b)/float32(d)
-        } // else should be zero
-
-        a = field[k][j+1][i]
-        b = field[k][j-1][i]
-        d = 2
-        if simThese[k][j+1][i] == 0 {
-          a = field[k][j][i]
-          d = d - 1
-        }
-        if simThese[k][j-1][i] == 0 {
-          b = field[k][j][i]
-          d = d - 1
-        }
-        if d > 0 {
-          gf[k][j][i*3+1] = (a-b)/float32(d)
-        } // else should be zero
-
-        a = field[k+1][j][i]
-        b = field[k-1][j][i]
-        d = 2
-        if simThese[k+1][j][i] == 0 {
-          a = field[k][j][i]
-          d = d - 1
-        }
-        if simThese[k-1][j][i] == 0 {
-          b = field[k][j][i]
-          d = d - 1
+        for c := 0; c < 3; c++ {
+          if st.name != "6" {
+            gf[k][j][i*3+c] = st.derivative(field, simThese, k, j, i, c)
+            continue
+          }
+          if scheme != "sobel" {
+            gf[k][j][i*3+c] = difference(field, simThese, k, j, i, c, upwind)
+            continue
+          }
+          // sobel: smooth the central differences with [1 2 1] perpendicular to the axis
+          var sum, weights float32
+          for d1 := -1; d1 <= 1; d1++ {
+            for d2 := -1; d2 <= 1; d2++ {
+              var o [3]int
+              o[(2-c+1)%3] = d1
+              o[(2-c+2)%3] = d2
+              kk := k+o[0]
+              jj := j+o[1]
+              ii := i+o[2]
+              if kk < 0 || jj < 0 || ii < 0 || kk >= dims[2] || jj >= dims[1] || ii >= dims[0] || simThese[kk][jj][ii] != maskSimulate {
+                continue
+              }
+              w := float32((2-d1*d1)*(2-d2*d2))
+              sum = sum + w*difference(field, simThese, kk, jj, ii, c, false)
+              weights = weights + w
+            }
+          }
+          gf[k][j][i*3+c] = sum/weights
         }
-        if d > 0 {
-          gf[k][j][i*3+2] = (a-b)/float32(d)
-        } // else should be zero
       }
     }
   }
@@ -688,8 +675,40 @@ func computeGradientField(field [][][]float32, labels [][][]uint8, simulate []in
   return gf
 }
 
+// Unit direction field and magnitude of the gradient in physical units (per mm using the voxel size)
+func normalizeGradient( gradient [][][]float32, head header ) ( [][][]float32, [][][]float32 ) {
+  vz := [3]float32{1, 1, 1}
+  if head.goodRASFlag == 1 {
+    vz = head.vz
+  }
+  dir := make([][][]float32, len(gradient))
+  mag := make([][][]float32, len(gradient))
+  for k := range gradient {
+    dir[k] = make([][]float32, len(gradient[k]))
+    mag[k] = make([][]float32, len(gradient[k]))
+    for j := range gradient[k] {
+      dir[k][j] = make([]float32, len(gradient[k][j]))
+      mag[k][j] = make([]float32, len(gradient[k][j])/3)
+      for i := range mag[k][j] {
+        var l float64
+        for c := 0; c < 3; c++ {
+          dir[k][j][i*3+c] = gradient[k][j][i*3+c] / vz[c]
+          l = l + float64(dir[k][j][i*3+c]*dir[k][j][i*3+c])
+        }
+        mag[k][j][i] = float32(math.Sqrt(l))
+        if mag[k][j][i] > 0 {
+          for c := 0; c < 3; c++ {
+            dir[k][j][i*3+c] = dir[k][j][i*3+c] / mag[k][j][i]
+          }
+        }
+      }
+    }
+  }
+  return dir, mag
+}
+
 // segment volume into distict regions based on heat value
-func computeDistanceField(field [][][]float32, labels [][][]uint8, simulate []int, numsegments int, verbose bool) ( [][][]uint8 ){
+func computeDistanceField(field [][][]float32, simThese [][][]uint8, numsegments int, verbose bool) ( [][][]uint8 ){
   // store end of each segment
   borders := make([]float32, numsegments-1) // keep a list of the (uniform distant) quantiles requested by the user
   for i := range borders {
@@ -698,9 +717,9 @@ func computeDistanceField(field [][][]float32, labels [][][]uint8, simulate []in
   }
 
   var dims [3]int
-  dims[2] = len(labels)
-  dims[1] = len(labels[0])
-  dims[0] = len(labels[0][0])
+  dims[2] = len(simThese)
+  dims[1] = len(simThese[0])
+  dims[0] = len(simThese[0][0])
   df := make([][][]uint8, dims[2])
   for i := range df {
     df[i] = make([][]uint8, dims[1])
@@ -710,36 +729,29 @@ func computeDistanceField(field [][][]float32, labels [][][]uint8, simulate []in
   }
   
   // we will compute quantiles for the actual separations
-  // we know that the temperature is between 0.01 and 0.1
-  // lets define numsegments quantiles for the field values in every label of labels that is listed in simulate
-  maxVal := float32(0.01)
-  minVal := float32(0.1)
+  // we know that the temperature is between lowTemperature and highTemperature
+  // lets define numsegments quantiles for the field values of the simulated voxel (class maskSimulate,
+  // see classifyVoxels)
+  maxVal := lowTemperature
+  minVal := highTemperature
 
-  simThese := make([][][]uint8, dims[2])
   for k := range simThese {
-     simThese[k] = make([][]uint8, dims[1])
      for j := range simThese[k] {
-       simThese[k][j] = make([]uint8, dims[0])
        for i := range simThese[k][j] {
-          simThese[k][j][i] = 0
-          val := int(labels[k][j][i])
-          for l := range simulate {
-             if simulate[l] == val {
-                simThese[k][j][i] = 1 // only export distance for these voxel
-                if field[k][j][i] < minVal {
-                  minVal = field[k][j][i]
-                }
-                if field[k][j][i] > maxVal {
-                  maxVal = field[k][j][i]
-                }
-                break
-             }
+          if simThese[k][j][i] != maskSimulate {
+            continue // only export distance for simulated voxel
+          }
+          if field[k][j][i] < minVal {
+            minVal = field[k][j][i]
+          }
+          if field[k][j][i] > maxVal {
+            maxVal = field[k][j][i]
           }
        }
      }
   }
   if verbose {
-    p(fmt.Sprintf("Simulated heat values are %g .. %g (should be 0.01 .. 0.1)", minVal, maxVal))
+    p(fmt.Sprintf("Simulated heat values are %g .. %g (should be %g .. %g)", minVal, maxVal, lowTemperature, highTemperature))
   }
 
   // collect a histogram of heat values (use it to compute a cummulative histogram later)
@@ -749,7 +761,7 @@ func computeDistanceField(field [][][]float32, labels [][][]uint8, simulate []in
   for k := range field {
     for j := range field[k] {
       for i := range field[k][j] {
-        if simThese[k][j][i] == 0 {
+        if simThese[k][j][i] != maskSimulate {
           continue
         }
         index := int( math.Floor( float64( ( (field[k][j][i] - minVal) / (maxVal-minVal)) * float32(histresolution-1) + 0.5) ))
@@ -790,7 +802,7 @@ func computeDistanceField(field [][][]float32, labels [][][]uint8, simulate []in
   for k := range df {
     for j := range df[k] {
       for i := range df[k][j] {
-          if simThese[k][j][i] == 0 {
+          if simThese[k][j][i] != maskSimulate {
             df[k][j][i] = 0
             continue
           }
@@ -810,7 +822,73 @@ func computeDistanceField(field [][][]float32, labels [][][]uint8, simulate []in
   return df  
 }
 
-func simulate( labels [][][]uint8, temp0 []int, temp1 []int, simulate []int, omega float32, iterations int, showAllTemps bool, verbose bool) ( [][][]float32 ){
+// classes of voxel used by the simulation
+const (
+  maskTemp0    uint8 = 0 // fixed at the low temperature
+  maskSimulate uint8 = 1 // the heat equation is solved for these voxel
+  maskOther    uint8 = 2 // don't simulate this label, repulsive boundary conditions
+  maskTemp1    uint8 = 3 // fixed at the high temperature
+)
+
+// memorize what label we do want to simulate, which labels are fixed at the low or high
+// temperatures and what labels are repulsive
+func classifyVoxels( labels [][][]uint8, temp0 []int, temp1 []int, simulate []int ) ( [][][]uint8 ) {
+  var dims [3]int
+  dims[2] = len(labels)
+  dims[1] = len(labels[0])
+  dims[0] = len(labels[0][0])
+  simThese := make([][][]uint8, dims[2])
+  for k := range simThese {
+    simThese[k] = make([][]uint8, dims[1])
+    for j := range simThese[k] {
+      simThese[k][j] = make([]uint8, dims[0])
+      for i := range simThese[k][j] {
+         simThese[k][j][i] = maskOther
+         val := int(labels[k][j][i])
+         for l := range temp0 {
+           if temp0[l] == val {
+             simThese[k][j][i] = maskTemp0
+           }
+         }
+         for l := range temp1 {
+           if temp1[l] == val {
+             simThese[k][j][i] = maskTemp1
+           }
+         }
+         for l := range simulate {
+           if simulate[l] == val {
+             simThese[k][j][i] = maskSimulate // yes simulate this voxel
+           }
+         }
+      }
+    }
+  }
+  return simThese
+}
+
+// summary of a simulation run
+type solverStats struct {
+  iterations int           // number of iterations performed
+  residual float32         // largest change of a voxel temperature in the last iteration
+  elapsed time.Duration    // time spend in the simulation
+  resumed int              // iterations done before the simulation was resumed from a checkpoint
+  interrupted bool         // stopped by a signal before all iterations were done
+}
+
+// optional start values and checkpoints of a simulation, the zero value starts a new simulation
+type simulationState struct {
+  initial [][][]float32    // start temperatures of the simulated voxel (default is the mean of the boundary temperatures)
+  first int                // number of iterations already done
+  checkpointEvery int      // call checkpoint every N iterations
+  checkpoint func( field [][][]float32, iteration int )
+  stop chan os.Signal      // write a checkpoint and stop the simulation if a signal arrives
+  mask [][][]uint8         // class of each voxel (see classifyVoxels), nil to classify the labels
+  source *sourceTerm       // source term of the Poisson equation, nil for the heat equation
+}
+
+// solve the heat equation, returns the temperature field, the class of each voxel (see classifyVoxels)
+// and a summary of the run
+func simulate( labels [][][]uint8, temp0 []int, temp1 []int, simulate []int, omega float32, iterations int, st stencil, showAllTemps bool, verbose bool, state simulationState) ( [][][]float32, [][][]uint8, solverStats ){
   // write the input field to fn
   var dims [3]int
   dims[2] = len(labels)
@@ -833,40 +911,29 @@ func simulate( labels [][][]uint8, temp0 []int, temp1 []int, simulate []int, ome
     }
   }
 
-  // memorize what label we do want to simulate (=1), and what labels are repulsive (=2)
-  simThese := make([][][]uint8, dims[2])
-  for i := range simThese {
-    simThese[i] = make([][]uint8, dims[1])
-    for j := range simThese[i] {
-      simThese[i][j] = make([]uint8, dims[0])
-    }
+  simThese := state.mask
+  if simThese == nil {
+    simThese = classifyVoxels(labels, temp0, temp1, simulate)
   }
   
   // set the initial temperatures
   for k := 0; k < dims[2]; k++ {
     for j := 0; j < dims[1]; j++ {
       for i := 0; i < dims[0]; i++ {
-         f[k][j][i] = 0.0
-         simThese[k][j][i] = 2 // don't simulate this label, repulsive boundary conditions
-         val := int(labels[k][j][i])
-         for l := range temp0 {
-           if temp0[l] == val {
-             f[k][j][i] = 0.01
-             simThese[k][j][i] = 0
-           }
-         }
-         for l := range temp1 {
-           if temp1[l] == val {
-             f[k][j][i] = 0.1
-             simThese[k][j][i] = 0
+         switch simThese[k][j][i] {
+         case maskTemp0:
+           f[k][j][i] = lowTemperature
+         case maskTemp1:
+           f[k][j][i] = highTemperature
+         case maskSimulate:
+           if state.initial != nil {
+             f[k][j][i] = state.initial[k][j][i]
+           } else {
+             f[k][j][i] = lowTemperature + (highTemperature-lowTemperature)/2.0 // initialize with the mean temperature of the two boundaries
            }
+         default:
+           f[k][j][i] = 0.0
          }
-         for l := range simulate {
-           if simulate[l] == val {
-             f[k][j][i] = 0.01 + (0.1-0.01)/2.0 // initialize with the mean temperature between 0.01 and 0.1
-             simThese[k][j][i] = 1 // yes simulate this voxel
-           }
-         }         
       }
     }
   }  
@@ -885,7 +952,13 @@ func simulate( labels [][][]uint8, temp0 []int, temp1 []int, simulate []int, ome
   var elapsed time.Duration
   elapsed = 0
   start   := time.Now()
-  for t := 0; t < maxTime; t++ {
+  var stats solverStats
+  stats.resumed = state.first
+  stats.iterations = state.first
+  begin := time.Now()
+  // largest change per row of voxel, used to report the residual of the last iteration
+  change := make([]float32, dims[2]*dims[1])
+  for t := state.first; t < maxTime; t++ {
     start = time.Now()
     var wg sync.WaitGroup
     wg.Add( (dims[2]-2)*(dims[1]-2) )
@@ -899,38 +972,21 @@ func simulate( labels [][][]uint8, temp0 []int, temp1 []int, simulate []int, ome
          // voxel)
          go func(k int, j int) {         
              defer wg.Done()
+             change[k*dims[1]+j] = 0
              for i := 1; i < dims[0]-1; i++ {
                 //tmp[k][j][i] = f[k][j][i]
-                if simThese[k][j][i] != 1 {
+                if simThese[k][j][i] != maskSimulate {
                   continue
                 }
                 var val111 = f[ k ][j][i]
-                var val101 = f[k][j-1][i]
-                var val121 = f[k][j+1][i]
-                var val011 = f[k][j][i-1]
-                var val211 = f[k][j][i+1]
-                var val110 = f[k-1][j][i]
-                var val112 = f[k+1][j][i]
-                // repulsive boundary conditions for all other label
-                if simThese[k][j-1][i] == 2 {
-                  val101 = val121
+                // repulsive boundary conditions for all other label (see stencil.update)
+                tmp[k][j][i] = st.update(f, simThese, k, j, i, omega)
+                if state.source != nil {
+                  tmp[k][j][i] = tmp[k][j][i] + omega*state.source.at(k, j, i)
                 }
-                if simThese[k][j+1][i] == 2 {
-                  val121 = val211
+                if d := tmp[k][j][i] - val111; d > change[k*dims[1]+j] || -d > change[k*dims[1]+j] {
+                  change[k*dims[1]+j] = float32(math.Abs(float64(d)))
                 }
-                if simThese[k][j][i-1] == 2 {
-                  val011 = val211
-                }
-                if simThese[k][j][i+1] == 2 {
-                  val211 = val011
-                }
-                if simThese[k-1][j][i] == 2 {
-                  val110 = val112
-                }
-                if simThese[k+1][j][i] == 2 {
-                  val112 = val110
-                }
-                tmp[k][j][i] = float32(1.0-6.0*omega)*val111 + omega*(val101 + val121 + val011 + val211 + val110 + val112)            
              }
          }(k, j)
        }
@@ -942,11 +998,33 @@ func simulate( labels [][][]uint8, temp0 []int, temp1 []int, simulate []int, ome
           copy(f[k][j][0:dims[0]], tmp[k][j][:])
        }
     }
+    stats.iterations = t+1
+    stats.residual = 0
+    for _, c := range change {
+      if c > stats.residual {
+        stats.residual = c
+      }
+    }
     elapsed = time.Since(start)
     if verbose {
       expected := time.Duration(elapsed.Seconds() * float64(maxTime-(t+1))) * time.Second
       fmt.Printf("\033[2K %04d/%d (%s/iteration, %s)\r", t+1, maxTime, elapsed.String(), expected.String())
     }
+    if state.checkpoint != nil {
+      stopped := false
+      select {
+      case <-state.stop:
+        stopped = true
+      default:
+      }
+      if stopped || (state.checkpointEvery > 0 && (t+1) % state.checkpointEvery == 0 && t+1 < maxTime) {
+        state.checkpoint(f, t+1)
+      }
+      if stopped {
+        stats.interrupted = true
+        break
+      }
+    }
   }
   
   // at the end leave only the simulated voxel in the image
@@ -955,7 +1033,7 @@ func simulate( labels [][][]uint8, temp0 []int, temp1 []int, simulate []int, ome
     for k := 0; k < dims[2]; k++ {
       for j := 0; j < dims[1]; j++ {
         for i := 0; i < dims[0]; i++ {
-            if simThese[k][j][i] != 1 {
+            if simThese[k][j][i] != maskSimulate {
               f[k][j][i] = 0
             }
         }
@@ -963,10 +1041,12 @@ func simulate( labels [][][]uint8, temp0 []int, temp1 []int, simulate []int, ome
     }
   }
   
+  stats.elapsed = time.Since(begin)
   if verbose {
     fmt.Printf("\n")
+    p(fmt.Sprintf("residual after %d iterations: %g", stats.iterations, stats.residual))
   }
-  return f
+  return f, simThese, stats
 }
 
 
@@ -0,0 +1,119 @@
+package main
+
+import (
+  "fmt"
+  "math"
+)
+
+// inverse of an affine 4x4 transformation
+func invertAffine( m [4][4]float32 ) ( [4][4]float64, error ) {
+  var r [4][4]float64
+  a := func( i, j int ) ( float64 ) { return float64(m[i][j]) }
+  det := a(0,0)*(a(1,1)*a(2,2)-a(1,2)*a(2,1)) - a(0,1)*(a(1,0)*a(2,2)-a(1,2)*a(2,0)) + a(0,2)*(a(1,0)*a(2,1)-a(1,1)*a(2,0))
+  if det == 0 {
+    return r, fmt.Errorf("singular voxel to ras transformation")
+  }
+  r[0][0] = (a(1,1)*a(2,2) - a(1,2)*a(2,1)) / det
+  r[0][1] = (a(0,2)*a(2,1) - a(0,1)*a(2,2)) / det
+  r[0][2] = (a(0,1)*a(1,2) - a(0,2)*a(1,1)) / det
+  r[1][0] = (a(1,2)*a(2,0) - a(1,0)*a(2,2)) / det
+  r[1][1] = (a(0,0)*a(2,2) - a(0,2)*a(2,0)) / det
+  r[1][2] = (a(0,2)*a(1,0) - a(0,0)*a(1,2)) / det
+  r[2][0] = (a(1,0)*a(2,1) - a(1,1)*a(2,0)) / det
+  r[2][1] = (a(0,1)*a(2,0) - a(0,0)*a(2,1)) / det
+  r[2][2] = (a(0,0)*a(1,1) - a(0,1)*a(1,0)) / det
+  for i := 0; i < 3; i++ {
+    r[i][3] = -(r[i][0]*a(0,3) + r[i][1]*a(1,3) + r[i][2]*a(2,3))
+  }
+  r[3][3] = 1
+  return r, nil
+}
+
+// true if v is a temperature between the two boundary temperatures
+func validTemperature( v float32 ) ( bool ) {
+  return v >= lowTemperature && v <= highTemperature
+}
+
+// Resample a temperature field onto the voxel grid of head using the geometry of both volumes
+// (trilinear interpolation). Only valid temperatures are interpolated, voxel without a valid
+// neighbor (outside the field or not simulated before) are set to NaN.
+func resampleTemperature( field [][][]float32, fhead header, head header ) ( [][][]float32, error ) {
+  inv, err := invertAffine(vox2ras(fhead))
+  if err != nil {
+    return nil, err
+  }
+  m := vox2ras(head)
+  // voxel of head to voxel of field
+  var t [3][4]float64
+  for r := 0; r < 3; r++ {
+    for c := 0; c < 4; c++ {
+      for n := 0; n < 4; n++ {
+        t[r][c] = t[r][c] + inv[r][n]*float64(m[n][c])
+      }
+    }
+  }
+  fdims := [3]int{int(fhead.width), int(fhead.height), int(fhead.depth)}
+  out := make([][][]float32, head.depth)
+  for k := range out {
+    out[k] = make([][]float32, head.height)
+    for j := range out[k] {
+      out[k][j] = make([]float32, head.width)
+      for i := range out[k][j] {
+        var pos [3]float64
+        for r := 0; r < 3; r++ {
+          pos[r] = t[r][0]*float64(i) + t[r][1]*float64(j) + t[r][2]*float64(k) + t[r][3]
+        }
+        i0 := int(math.Floor(pos[0]))
+        j0 := int(math.Floor(pos[1]))
+        k0 := int(math.Floor(pos[2]))
+        var sum, wsum float64
+        for n := 0; n < 8; n++ {
+          ii, jj, kk := i0 + n&1, j0 + (n>>1)&1, k0 + (n>>2)&1
+          if ii < 0 || jj < 0 || kk < 0 || ii >= fdims[0] || jj >= fdims[1] || kk >= fdims[2] {
+            continue
+          }
+          v := field[kk][jj][ii]
+          if !validTemperature(v) {
+            continue
+          }
+          w := (1 - math.Abs(pos[0]-float64(ii))) * (1 - math.Abs(pos[1]-float64(jj))) * (1 - math.Abs(pos[2]-float64(kk)))
+          sum = sum + w*float64(v)
+          wsum = wsum + w
+        }
+        if wsum > 1e-6 {
+          out[k][j][i] = float32(sum/wsum)
+        } else {
+          out[k][j][i] = float32(math.NaN())
+        }
+      }
+    }
+  }
+  return out, nil
+}
+
+// Read a previous temperature field (--init) as start values for the simulation. Fields with
+// another voxel grid (e.g. a coarse solution) are resampled. Voxel without a valid temperature
+// (not simulated in the previous run) start with the mean of the boundary temperatures.
+func readInitialField( fn string, head header, verbose bool ) ( [][][]float32, error ) {
+  field, fhead := readMGHfloat(fn, verbose)
+  if !sameDimensions(fhead, head) || fhead.vz != head.vz || fhead.Mdc != head.Mdc || fhead.Pxyz != head.Pxyz {
+    if verbose {
+      p(fmt.Sprintf("resample %s to the voxel grid of the label field", fn))
+    }
+    var err error
+    field, err = resampleTemperature(field, fhead, head)
+    if err != nil {
+      return nil, fmt.Errorf("could not resample %s (%s)", fn, err)
+    }
+  }
+  for k := range field {
+    for j := range field[k] {
+      for i := range field[k][j] {
+        if !validTemperature(field[k][j][i]) {
+          field[k][j][i] = lowTemperature + (highTemperature-lowTemperature)/2.0
+        }
+      }
+    }
+  }
+  return field, nil
+}